@@ -0,0 +1,229 @@
+package mdathome
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// accessBatchSize is how many entries are read from the access index per transaction
+const accessBatchSize = 1000
+
+// getAccessKey returns the access index key of an entry, which sorts by timestamp and then by hash
+func getAccessKey(timestamp int64, hash string) []byte {
+	key := make([]byte, 8+len(hash))
+	binary.BigEndian.PutUint64(key, uint64(timestamp))
+	copy(key[8:], hash)
+	return key
+}
+
+// getEvictionKey returns the eviction index key of an entry, which sorts by class, then by priority
+// and then by hash
+func getEvictionKey(class byte, priority float64, hash string) []byte {
+	key := make([]byte, 9+len(hash))
+	key[0] = class
+
+	// Flip bits so that floats sort as unsigned integers
+	bits := math.Float64bits(priority)
+	if priority >= 0 {
+		bits ^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	binary.BigEndian.PutUint64(key[1:], bits)
+	copy(key[9:], hash)
+	return key
+}
+
+// putIndexEntries adds the access and eviction index entries of an entry
+func (c *Cache) putIndexEntries(tx *bolt.Tx, keyPair KeyPair) error {
+	if err := writeBucket(tx, "ACCESS").Put(getAccessKey(keyPair.Timestamp, keyPair.Key), nil); err != nil {
+		return fmt.Errorf("could not set access entry: %v", err)
+	}
+	class, priority := c.policy.Order(keyPair)
+	if err := writeBucket(tx, "EVICTION").Put(getEvictionKey(class, priority, keyPair.Key), nil); err != nil {
+		return fmt.Errorf("could not set eviction entry: %v", err)
+	}
+	return nil
+}
+
+// deleteIndexEntries removes the access and eviction index entries of an existing entry, returning
+// the entry if there is one
+func (c *Cache) deleteIndexEntries(tx *bolt.Tx, hash string) (*KeyPair, error) {
+	keyPairBytes := tx.Bucket([]byte("KEYS")).Get([]byte(hash))
+	if keyPairBytes == nil {
+		return nil, nil
+	}
+	keyPair, err := decodeKeyPair([]byte(hash), keyPairBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeBucket(tx, "ACCESS").Delete(getAccessKey(keyPair.Timestamp, hash)); err != nil {
+		return nil, fmt.Errorf("could not delete access entry: %v", err)
+	}
+	class, priority := c.policy.Order(keyPair)
+	if err := writeBucket(tx, "EVICTION").Delete(getEvictionKey(class, priority, hash)); err != nil {
+		return nil, fmt.Errorf("could not delete eviction entry: %v", err)
+	}
+	return &keyPair, nil
+}
+
+// forEachByAccess calls fn with every entry from least to most recently used until it returns false.
+// Entries are read in batches, so fn may modify the database.
+func (c *Cache) forEachByAccess(fn func(keyPair KeyPair) bool) error {
+	return c.forEachInIndex("ACCESS", 8, nil, fn)
+}
+
+// forEachByAccessSince calls fn with every entry last used at or after a time, from least to most
+// recently used, until it returns false
+func (c *Cache) forEachByAccessSince(since int64, fn func(keyPair KeyPair) bool) error {
+	return c.forEachInIndex("ACCESS", 8, getAccessKey(since, ""), fn)
+}
+
+// forEachByEviction calls fn with every entry in eviction order from a position until it returns false.
+// Entries are read in batches, so fn may modify the database.
+func (c *Cache) forEachByEviction(start []byte, fn func(keyPair KeyPair) bool) error {
+	return c.forEachInIndex("EVICTION", 9, start, fn)
+}
+
+// forEachInIndex calls fn with every entry of an index bucket, whose keys end in the hash after a
+// prefix of the given length, from a position until it returns false
+func (c *Cache) forEachInIndex(bucket string, prefixLength int, start []byte, fn func(keyPair KeyPair) bool) error {
+	var after []byte
+	for {
+		// Read next batch of entries
+		var batch []KeyPair
+		if err := c.database.View(func(tx *bolt.Tx) error {
+			keys := tx.Bucket([]byte("KEYS"))
+			cur := tx.Bucket([]byte(bucket)).Cursor()
+
+			// Continue after last entry of previous batch
+			indexKey, _ := cur.Seek(start)
+			if after != nil {
+				if indexKey, _ = cur.Seek(after); bytes.Equal(indexKey, after) {
+					indexKey, _ = cur.Next()
+				}
+			}
+
+			for ; indexKey != nil && len(batch) < accessBatchSize; indexKey, _ = cur.Next() {
+				after = append(after[:0], indexKey...)
+
+				// Skip index entries whose entry is gone
+				keyPairBytes := keys.Get(indexKey[prefixLength:])
+				if keyPairBytes == nil {
+					continue
+				}
+				keyPair, err := decodeKeyPair(indexKey[prefixLength:], keyPairBytes)
+				if err != nil {
+					return err
+				}
+				batch = append(batch, keyPair)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		// Hand entries over
+		for _, keyPair := range batch {
+			if !fn(keyPair) {
+				return nil
+			}
+		}
+	}
+}
+
+// buildIndexes rebuilds the access and eviction indexes from every entry unless they were completed for
+// the current eviction policy, such as for databases created before they existed, after the eviction
+// policy changed or after an interrupted rebuild
+func (c *Cache) buildIndexes() error {
+	// Check whether indexes were completed for the current policy, which entries keep them in step with
+	complete := true
+	if err := c.database.View(func(tx *bolt.Tx) error {
+		complete = string(tx.Bucket([]byte("META")).Get([]byte("indexed"))) == c.policy.Name()
+		return nil
+	}); err != nil {
+		return err
+	}
+	if complete {
+		return nil
+	}
+	log.Infof("Building indexes for %s eviction policy...", c.policy.Name())
+
+	// Start from scratch
+	if err := c.database.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{"ACCESS", "EVICTION"} {
+			if err := deleteBucket(tx, bucket); err != nil {
+				return err
+			}
+			if err := createBucket(tx, bucket); err != nil {
+				return err
+			}
+		}
+		return writeBucket(tx, "META").Delete([]byte("indexed"))
+	}); err != nil {
+		return fmt.Errorf("could not recreate buckets: %v", err)
+	}
+
+	// Index entries a batch at a time
+	var after []byte
+	indexed := 0
+	for {
+		var keyPairs []KeyPair
+		if err := c.database.View(func(tx *bolt.Tx) error {
+			cur := tx.Bucket([]byte("KEYS")).Cursor()
+
+			// Continue after last entry of previous batch
+			key, keyPairBytes := cur.First()
+			if after != nil {
+				if key, keyPairBytes = cur.Seek(after); bytes.Equal(key, after) {
+					key, keyPairBytes = cur.Next()
+				}
+			}
+
+			for ; key != nil && len(keyPairs) < accessBatchSize*10; key, keyPairBytes = cur.Next() {
+				after = append(after[:0], key...)
+				keyPair, err := decodeKeyPair(key, keyPairBytes)
+				if err != nil {
+					return err
+				}
+				keyPair.Key = string(key)
+				keyPairs = append(keyPairs, keyPair)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if len(keyPairs) == 0 {
+			break
+		}
+
+		// Write batch
+		if err := c.database.Update(func(tx *bolt.Tx) error {
+			for _, keyPair := range keyPairs {
+				if err := c.putIndexEntries(tx, keyPair); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		indexed += len(keyPairs)
+	}
+
+	// Remember that indexes are complete
+	if err := c.database.Update(func(tx *bolt.Tx) error {
+		return writeBucket(tx, "META").Put([]byte("indexed"), []byte(c.policy.Name()))
+	}); err != nil {
+		return fmt.Errorf("could not mark indexes as built: %v", err)
+	}
+	log.Infof("Indexes built with %d entries", indexed)
+	return nil
+}
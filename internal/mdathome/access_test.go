@@ -0,0 +1,97 @@
+package mdathome
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// setTestImages caches an image for every name, returning the names by cache key
+func setTestImages(t *testing.T, c *Cache, names ...string) map[string]string {
+	t.Helper()
+	hashes := make(map[string]string)
+	for _, name := range names {
+		requestURI := fmt.Sprintf("/data/x/%s.png", name)
+		if err := c.Set(requestURI, time.Now(), []byte("image "+name)); err != nil {
+			t.Fatalf("Failed to cache image %s: %v", name, err)
+		}
+		hashes[hashRequestURI(requestURI)] = name
+	}
+	return hashes
+}
+
+// updateTestEntry modifies the entry of a cached image
+func updateTestEntry(t *testing.T, c *Cache, name string, update func(keyPair *KeyPair)) {
+	t.Helper()
+	keyPair, err := c.getEntry(hashRequestURI(fmt.Sprintf("/data/x/%s.png", name)))
+	if err != nil {
+		t.Fatalf("Failed to get entry of %s: %v", name, err)
+	}
+	update(&keyPair)
+	if err := c.setEntry(keyPair); err != nil {
+		t.Fatalf("Failed to update entry of %s: %v", name, err)
+	}
+}
+
+// collectNames returns an iteration callback appending the names of entries to a slice
+func collectNames(names map[string]string, order *[]string) func(keyPair KeyPair) bool {
+	return func(keyPair KeyPair) bool {
+		*order = append(*order, names[keyPair.Key])
+		return true
+	}
+}
+
+func TestAccessIndexOrder(t *testing.T) {
+	c := newTestCache(t, 1<<30)
+	names := setTestImages(t, c, "a", "b", "c")
+	now := time.Now().Unix()
+	for name, age := range map[string]int64{"a": 300, "b": 100, "c": 200} {
+		updateTestEntry(t, c, name, func(keyPair *KeyPair) {
+			keyPair.Timestamp = now - age
+		})
+	}
+
+	// Entries are iterated from least to most recently used
+	var order []string
+	if err := c.forEachByAccess(collectNames(names, &order)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(order, []string{"a", "c", "b"}) {
+		t.Fatalf("Unexpected access order %v", order)
+	}
+	order = nil
+	if err := c.forEachByAccessSince(now-250, collectNames(names, &order)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(order, []string{"c", "b"}) {
+		t.Fatalf("Unexpected access order since %v", order)
+	}
+
+	// Entries hit since their stats were written are kept and move to the back
+	a, _ := c.getEntry(hashRequestURI("/data/x/a.png"))
+	c.recordHit(a)
+	if c.evict(a) {
+		t.Fatalf("Expected hit entry to be kept")
+	}
+	order = nil
+	if err := c.forEachByAccess(collectNames(names, &order)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(order, []string{"c", "b", "a"}) {
+		t.Fatalf("Unexpected access order after hit %v", order)
+	}
+
+	// Other entries are deleted along with their image
+	victim, _ := c.getEntry(hashRequestURI("/data/x/c.png"))
+	if !c.evict(victim) {
+		t.Fatalf("Expected entry to be evicted")
+	}
+	if _, err := c.getEntry(victim.Key); err == nil {
+		t.Fatalf("Expected evicted entry to be deleted")
+	}
+	if _, err := os.Stat(getTestImagePath(t, c, "/data/x/c.png")); !os.IsNotExist(err) {
+		t.Fatalf("Expected evicted image to be removed, got %v", err)
+	}
+}
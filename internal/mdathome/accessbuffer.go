@@ -0,0 +1,172 @@
+package mdathome
+
+import (
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+// hitsBatchSize is how many entries are written back per batched transaction
+const hitsBatchSize = 1000
+
+var clientCacheAccessDroppedTotal = metrics.NewCounter("client_cache_access_dropped_total")
+
+// recordHit counts a hit on an entry in memory, marking it due for writing back once it is older than
+// the configured refresh age or has gathered enough hits. Due entries are written back by the access
+// thread so that hits only wait on the database when the buffer is full.
+func (c *Cache) recordHit(keyPair KeyPair) {
+	c.hitsMu.Lock()
+	defer c.hitsMu.Unlock()
+
+	// Write buffer back once full, only dropping hits on new entries if that failed
+	hits, ok := c.hits[keyPair.Key]
+	if !ok && len(c.hits) >= viper.GetInt("cache.access_buffer_entries") {
+		c.hitsMu.Unlock()
+		c.flushHits(false)
+		c.hitsMu.Lock()
+		if hits, ok = c.hits[keyPair.Key]; !ok && len(c.hits) >= viper.GetInt("cache.access_buffer_entries") {
+			clientCacheAccessDroppedTotal.Inc()
+			return
+		}
+	}
+	c.hits[keyPair.Key] = hits + 1
+
+	// Mark entry due if its stats should be written back
+	if hits+1 >= policyHitsPerUpdate || c.isStale(keyPair) {
+		c.due[keyPair.Key] = struct{}{}
+		if len(c.due) >= viper.GetInt("cache.access_flush_entries") {
+			c.requestFlush()
+		}
+	}
+}
+
+// requestFlush wakes the access thread without waiting for it
+func (c *Cache) requestFlush() {
+	select {
+	case c.flushRequests <- struct{}{}:
+	default:
+	}
+}
+
+// takeHits returns and forgets the hits of an entry that were not yet written back
+func (c *Cache) takeHits(hash string) int {
+	c.hitsMu.Lock()
+	defer c.hitsMu.Unlock()
+	hits := c.hits[hash]
+	delete(c.hits, hash)
+	delete(c.due, hash)
+	return hits
+}
+
+// StartAccessThread writes back due entries every few seconds, or sooner when enough are due, till the
+// cache is closed
+func (c *Cache) StartAccessThread() {
+	// Flush at least every second if no interval is configured
+	interval := time.Duration(viper.GetInt("cache.access_flush_interval_seconds")) * time.Second
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.flushRequests:
+		case <-c.done:
+			return
+		}
+		c.flushHits(false)
+	}
+}
+
+// flushHits writes back the hits of due entries, or of every entry if asked to or if the buffer is full
+func (c *Cache) flushHits(all bool) {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	if c.closed {
+		return
+	}
+
+	// Take hits out of buffer
+	c.hitsMu.Lock()
+	all = all || len(c.hits) >= viper.GetInt("cache.access_buffer_entries")
+	pending := make(map[string]int)
+	if all {
+		pending, c.hits = c.hits, make(map[string]int)
+		c.due = make(map[string]struct{})
+	} else {
+		for hash := range c.due {
+			pending[hash] = c.hits[hash]
+			delete(c.hits, hash)
+		}
+		c.due = make(map[string]struct{})
+	}
+	c.hitsMu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	// Write back in batches
+	hashes := make([]string, 0, len(pending))
+	for hash := range pending {
+		hashes = append(hashes, hash)
+	}
+	for start := 0; start < len(hashes); start += hitsBatchSize {
+		chunk := hashes[start:min(start+hitsBatchSize, len(hashes))]
+		if err := c.writeHits(chunk, pending); err != nil {
+			log.Errorf("Failed to write back %d cache hits: %v", len(chunk), err)
+
+			// Return hits to buffer to retry later
+			c.hitsMu.Lock()
+			for _, hash := range chunk {
+				c.hits[hash] += pending[hash]
+				c.due[hash] = struct{}{}
+			}
+			c.hitsMu.Unlock()
+		}
+	}
+	log.Debugf("Wrote back hits of %d cache entries", len(pending))
+}
+
+// writeHits folds pending hits into their entries in one batched transaction, refreshing their timestamps
+func (c *Cache) writeHits(hashes []string, pending map[string]int) error {
+	// Batch may run the function more than once, so only keep the entries of its last run
+	var updated []KeyPair
+	err := c.database.Batch(func(tx *bolt.Tx) error {
+		updated = updated[:0]
+		b := tx.Bucket([]byte("KEYS"))
+		for _, hash := range hashes {
+			// Skip entries deleted since
+			keyPairBytes := b.Get([]byte(hash))
+			if keyPairBytes == nil {
+				continue
+			}
+			keyPair, err := decodeKeyPair([]byte(hash), keyPairBytes)
+			if err != nil {
+				return err
+			}
+
+			// Fold hits into stats before the timestamp they decay from is refreshed
+			hits := pending[hash]
+			keyPair.HitCount += int64(hits)
+			c.policy.Hit(&keyPair, hits)
+			keyPair.UpdateTimestamp()
+			if err := c.setEntryInTx(tx, keyPair); err != nil {
+				return err
+			}
+			updated = append(updated, keyPair)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Keep memory tier in step
+	for _, keyPair := range updated {
+		c.memory.Touch(keyPair)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package mdathome
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestFullAccessBufferWrittenBack(t *testing.T) {
+	c := newTestCache(t, 1<<30)
+	viper.Set("cache.access_buffer_entries", 2)
+	t.Cleanup(func() {
+		viper.Set("cache.access_buffer_entries", nil)
+	})
+	for i := 0; i < 3; i++ {
+		if err := c.Set(fmt.Sprintf("/data/x/%d.png", i), time.Now(), []byte("image")); err != nil {
+			t.Fatalf("Failed to cache image %d: %v", i, err)
+		}
+	}
+
+	// Hits beyond the buffer write it back rather than being dropped
+	dropped := clientCacheAccessDroppedTotal.Get()
+	for i := 0; i < 3; i++ {
+		object, _, err := c.Get(fmt.Sprintf("/data/x/%d.png", i))
+		if err != nil {
+			t.Fatalf("Failed to get image %d: %v", i, err)
+		}
+		object.Close()
+	}
+	if n := clientCacheAccessDroppedTotal.Get(); n != dropped {
+		t.Fatalf("Expected no hits to be dropped, %d were", n-dropped)
+	}
+	for i := 0; i < 2; i++ {
+		keyPair, err := c.getEntry(hashRequestURI(fmt.Sprintf("/data/x/%d.png", i)))
+		if err != nil {
+			t.Fatalf("Failed to get entry %d: %v", i, err)
+		}
+		if keyPair.HitCount != 1 {
+			t.Fatalf("Expected hit on entry %d to be written back, got %d hits", i, keyPair.HitCount)
+		}
+	}
+	if hits := c.takeHits(hashRequestURI("/data/x/2.png")); hits != 1 {
+		t.Fatalf("Expected hit on last entry to be buffered, got %d", hits)
+	}
+}
@@ -0,0 +1,172 @@
+package mdathome
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+// admissionSketchDepth is how many rows of counters the count-min sketch keeps
+const admissionSketchDepth = 4
+
+// admissionMaxCount is the value counters saturate at, which is all a frequency comparison needs
+const admissionMaxCount = 15
+
+// errNotAdmitted is returned when creating an image the admission filter decided to keep out of the cache
+var errNotAdmitted = errors.New("image not admitted")
+
+var (
+	clientCacheAdmittedTotal = metrics.NewCounter("client_cache_admitted_total")
+	clientCacheRejectedTotal = metrics.NewCounter("client_cache_rejected_total")
+)
+
+// countMinSketch estimates how often keys were requested recently. Every counter is halved once as
+// many requests as ten times the width of the sketch have been counted, so that old popularity fades.
+type countMinSketch struct {
+	mu       sync.Mutex
+	rows     [admissionSketchDepth][]uint8
+	mask     uint64
+	samples  int
+	resetAt  int
+	observed int
+}
+
+// newCountMinSketch returns a sketch with rows of at least the given width, rounded up to a power of two
+func newCountMinSketch(width int) *countMinSketch {
+	size := 1
+	for size < width {
+		size <<= 1
+	}
+	s := &countMinSketch{mask: uint64(size - 1), resetAt: size * 10}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, size)
+	}
+	return s
+}
+
+// getIndexes returns the counter of a key in every row through double hashing
+func (s *countMinSketch) getIndexes(key string) [admissionSketchDepth]uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	lower, upper := sum&0xffffffff, sum>>32|1
+
+	var indexes [admissionSketchDepth]uint64
+	for i := range indexes {
+		indexes[i] = (lower + uint64(i)*upper) & s.mask
+	}
+	return indexes
+}
+
+// Increment counts a request for a key
+func (s *countMinSketch) Increment(key string) {
+	indexes := s.getIndexes(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, index := range indexes {
+		if s.rows[i][index] < admissionMaxCount {
+			s.rows[i][index]++
+		}
+	}
+	s.observed++
+
+	// Age counters once enough requests were seen
+	if s.samples++; s.samples >= s.resetAt {
+		for _, row := range s.rows {
+			for j := range row {
+				row[j] >>= 1
+			}
+		}
+		s.samples /= 2
+	}
+}
+
+// Estimate returns the approximate number of recent requests for a key
+func (s *countMinSketch) Estimate(key string) int {
+	indexes := s.getIndexes(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	estimate := admissionMaxCount
+	for i, index := range indexes {
+		if count := int(s.rows[i][index]); count < estimate {
+			estimate = count
+		}
+	}
+	return estimate
+}
+
+// Observed returns how many requests were counted since startup
+func (s *countMinSketch) Observed() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.observed
+}
+
+// recordRequest counts a request for an image towards its admission frequency
+func (c *Cache) recordRequest(requestURI string) {
+	if viper.GetBool("cache.admission.enabled") {
+		c.sketch.Increment(hashRequestURI(requestURI))
+	}
+}
+
+// admit decides whether a newly requested image is worth caching, which is the case if the cache still
+// has room, the filter is still warming up, or it was requested more often recently than the image
+// that would be evicted next
+func (c *Cache) admit(hash string) bool {
+	if !viper.GetBool("cache.admission.enabled") {
+		return true
+	}
+
+	// Admit everything while warming up
+	if int(clientCacheSize.Get()) < c.cacheLimitInBytes*viper.GetInt("cache.admission.warmup_percent")/100 {
+		return true
+	}
+	if c.sketch.Observed() < viper.GetInt("cache.admission.warmup_requests") {
+		return true
+	}
+
+	// Compare against next victim of the eviction policy
+	victim, err := c.nextVictim()
+	if err != nil {
+		log.Warnf("Failed to find eviction victim, admitting %s: %v", hash, err)
+		return true
+	}
+	if victim == "" || victim == hash {
+		return true
+	}
+	return c.sketch.Estimate(hash) > c.sketch.Estimate(victim)
+}
+
+// nextVictim returns the hash of the image the eviction policy would evict next, wrapping around to the
+// start of the index, or an empty string if the cache is empty
+func (c *Cache) nextVictim() (string, error) {
+	start := c.policy.Start(c.cacheLimitInBytes)
+	var victim string
+	err := c.database.View(func(tx *bolt.Tx) error {
+		keys := tx.Bucket([]byte("KEYS"))
+		cur := tx.Bucket([]byte("EVICTION")).Cursor()
+
+		// Stop at first index entry whose entry still exists
+		find := func(indexKey []byte) bool {
+			for ; indexKey != nil; indexKey, _ = cur.Next() {
+				if keys.Get(indexKey[9:]) != nil {
+					victim = string(indexKey[9:])
+					return true
+				}
+			}
+			return false
+		}
+		if indexKey, _ := cur.Seek(start); !find(indexKey) && start != nil {
+			indexKey, _ = cur.First()
+			find(indexKey)
+		}
+		return nil
+	})
+	return victim, err
+}
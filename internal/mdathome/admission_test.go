@@ -0,0 +1,48 @@
+package mdathome
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestAdmissionDecidedBeforeWriting(t *testing.T) {
+	c := newTestCache(t, 1000)
+	viper.Set("cache.admission.enabled", true)
+	viper.Set("cache.admission.warmup_requests", 0)
+	t.Cleanup(func() {
+		viper.Set("cache.admission.enabled", nil)
+		viper.Set("cache.admission.warmup_requests", nil)
+	})
+
+	// Fill cache with images requested once
+	for i := 0; i < 10; i++ {
+		c.recordRequest(fmt.Sprint(i))
+		if err := c.Set(fmt.Sprint(i), time.Now(), make([]byte, 100)); err != nil {
+			t.Fatalf("Failed to cache image %d: %v", i, err)
+		}
+	}
+	clientCacheSize.Set(1000)
+	t.Cleanup(func() {
+		clientCacheSize.Set(0)
+	})
+
+	// Image no more popular than the next victim is refused without a writer
+	c.recordRequest("x")
+	if writer, err := c.Create("x"); !errors.Is(err, errNotAdmitted) || writer != nil {
+		t.Fatalf("Expected x to be refused, got %v", err)
+	}
+
+	// Image more popular than the next victim is admitted
+	c.recordRequest("y")
+	c.recordRequest("y")
+	if err := c.Set("y", time.Now(), make([]byte, 100)); err != nil {
+		t.Fatalf("Expected y to be admitted, got %v", err)
+	}
+	if _, _, err := c.Get("y"); err != nil {
+		t.Fatalf("Failed to get admitted image: %v", err)
+	}
+}
@@ -37,7 +37,7 @@ func controlPing() *ServerResponse {
 		Secret:       viper.GetString("client.secret"),
 		Port:         viper.GetInt("client.port"),
 		DiskSpace:    viper.GetInt("cache.max_size_mebibytes") * 1024 * 1024, // 1GB
-		NetworkSpeed: viper.GetInt("client.max_speed_kbps") * 1000 / 8,       // 100Mbps
+		NetworkSpeed: viper.GetInt(KeyMaxSpeed) * 1000 / 8,                   // 100Mbps
 		BuildVersion: ClientSpecification,
 		TLSCreatedAt: nil,
 	}
@@ -127,6 +127,11 @@ func controlGetCertificate() tls.Certificate {
 		log.Fatalln("Unable to contact API server!")
 	}
 
+	// Refuse to start serving if compromised
+	if serverResponse.Compromised {
+		log.Fatalln("Control server reports this client as compromised, refusing to start!")
+	}
+
 	// Parse TLS certificate
 	keyPair, err := tls.X509KeyPair([]byte(serverResponse.TLS.Certificate), []byte(serverResponse.TLS.PrivateKey))
 	if err != nil {
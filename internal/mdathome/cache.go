@@ -1,14 +1,17 @@
 package mdathome
 
 import (
+	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"os/signal"
-	"sort"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -23,23 +26,36 @@ var (
 	clientCacheEvicted = metrics.NewCounter("client_cache_evicted_bytes")
 )
 
+// keyPairVersion is the version of entries written by this client. Entries of older versions are
+// upgraded the next time they are read.
+const keyPairVersion = 1
+
 type KeyPair struct {
 	Key       string
 	Timestamp int64
 	Size      int
+	SHA256    string `json:",omitempty"`
+
+	// Metadata of the image, since version 1
+	Version      int    `json:",omitempty"`
+	URL          string `json:",omitempty"`
+	ContentType  string `json:",omitempty"`
+	LastModified int64  `json:",omitempty"`
+	HitCount     int64  `json:",omitempty"`
+
+	// Stats kept by the eviction policy
+	Hits  float64 `json:",omitempty"`
+	Score float64 `json:",omitempty"`
+	Queue int     `json:",omitempty"`
+
+	// Storage tier holding the image, if tiered
+	Tier string `json:",omitempty"`
 }
 
 func (a *KeyPair) UpdateTimestamp() {
 	a.Timestamp = time.Now().Unix()
 }
 
-func getPathFromHash(hash string) (string, string) {
-	dir := hash[0:2] + "/" + hash[2:4] + "/" + hash[4:6]
-	parent := viper.GetString("cache.directory") + "/" + dir
-	path := parent + "/" + hash
-	return parent, path
-}
-
 func hashRequestURI(requestURI string) string {
 	// Create MD5 hasher
 	h := md5.New()
@@ -56,26 +72,36 @@ func hashRequestURI(requestURI string) string {
 
 type Cache struct {
 	cacheLimitInBytes int
-	database          *bolt.DB
+	database          *cacheDatabase
+	storage           Storage
+	memory            *memoryTier
+	policy            evictionPolicy
+	sketch            *countMinSketch
+
+	// Hits not yet written back to entries, and which of them are due
+	hitsMu        sync.Mutex
+	hits          map[string]int
+	due           map[string]struct{}
+	flushRequests chan struct{}
+	done          chan struct{}
+
+	// Serialises writing back hits with closing the database
+	flushMu sync.Mutex
+	closed  bool
 }
 
 func (c *Cache) DeleteFileByKey(hash string) error {
-	_, path := getPathFromHash(hash)
+	// Drop image from memory along with its pending hits
+	c.memory.Delete(hash)
+	c.takeHits(hash)
 
-	// Delete file off disk
-	if err := os.Remove(path); err != nil {
+	// Delete image off storage
+	if err := c.storage.Delete(hash); err != nil {
 		log.Errorf("File does not seem to exist on disk, ignoring: %v", err)
 	}
 
-	// Delete key off database
-	if err := c.database.Update(func(tx *bolt.Tx) error {
-		if err := tx.Bucket([]byte("KEYS")).Delete([]byte(hash)); err != nil {
-			return fmt.Errorf("could not delete entry: %v", err)
-		}
-
-		// Return with no errors
-		return nil
-	}); err != nil {
+	// Delete key and its index entries off database
+	if err := c.deleteEntry(hash); err != nil {
 		return fmt.Errorf("entry does not exist on database: %v", err)
 	}
 
@@ -83,150 +109,396 @@ func (c *Cache) DeleteFileByKey(hash string) error {
 	return nil
 }
 
-// setEntry adds or modifies an entry in the database from a keyPair
-func (c *Cache) setEntry(keyPair KeyPair) error {
-	// Marshal keyPair struct into bytes
-	keyPairBytes, err := json.Marshal(keyPair)
-	if err != nil {
-		return fmt.Errorf("unable to marshal keyPair: %v", err)
+// deleteEntry removes an entry and its index entries from the database
+func (c *Cache) deleteEntry(hash string) error {
+	return c.database.Update(func(tx *bolt.Tx) error {
+		return c.deleteEntryInTx(tx, hash)
+	})
+}
+
+// deleteEntryInTx removes an entry and its index entries within a transaction, taking it off the totals
+func (c *Cache) deleteEntryInTx(tx *bolt.Tx, hash string) error {
+	previous, err := c.deleteIndexEntries(tx, hash)
+	if err != nil || previous == nil {
+		return err
 	}
+	if err := writeBucket(tx, "KEYS").Delete([]byte(hash)); err != nil {
+		return fmt.Errorf("could not delete entry: %v", err)
+	}
+	return addTotals(tx, -1*int64(previous.Size), -1)
+}
+
+// Purge removes the cached image for a key, such as when it is found to be corrupted
+func (c *Cache) Purge(requestURI string) error {
+	// Get cache key
+	hash := hashRequestURI(requestURI)
 
-	// Update database with marshaled keyPair
-	err = c.database.Update(func(tx *bolt.Tx) error {
-		err = tx.Bucket([]byte("KEYS")).Put([]byte(keyPair.Key), keyPairBytes)
-		if err != nil {
-			return fmt.Errorf("could not set entry: %v", err)
+	// Delete file and entry
+	return c.DeleteFileByKey(hash)
+}
+
+// forgetKeys deletes every entry matching a key predicate, such as those on a failed disk, so that
+// they are fetched again instead of being served. Entries are read and deleted a batch at a time, with
+// the predicate called outside of transactions as it may touch the disk.
+func (c *Cache) forgetKeys(match func(hash string) bool) {
+	forgottenSize := 0
+	forgottenItems := 0
+	var after []byte
+	for {
+		// Read next batch of keys
+		var hashes []string
+		if err := c.database.View(func(tx *bolt.Tx) error {
+			cur := tx.Bucket([]byte("KEYS")).Cursor()
+
+			// Continue after last key of previous batch
+			key, _ := cur.First()
+			if after != nil {
+				if key, _ = cur.Seek(after); bytes.Equal(key, after) {
+					key, _ = cur.Next()
+				}
+			}
+
+			for ; key != nil && len(hashes) < accessBatchSize*10; key, _ = cur.Next() {
+				after = append(after[:0], key...)
+				hashes = append(hashes, string(key))
+			}
+			return nil
+		}); err != nil {
+			log.Errorf("Failed to forget missing images: %v", err)
+			return
 		}
-		return nil
+		if len(hashes) == 0 {
+			break
+		}
+
+		// Find matching entries
+		var matched []string
+		for _, hash := range hashes {
+			if match(hash) {
+				matched = append(matched, hash)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		// Delete them
+		if err := c.database.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("KEYS"))
+			for _, hash := range matched {
+				keyPairBytes := b.Get([]byte(hash))
+				if keyPairBytes == nil {
+					continue
+				}
+				if keyPair, err := decodeKeyPair([]byte(hash), keyPairBytes); err == nil {
+					forgottenSize += keyPair.Size
+				}
+				if err := c.deleteEntryInTx(tx, hash); err != nil {
+					return err
+				}
+				forgottenItems++
+			}
+			return nil
+		}); err != nil {
+			log.Errorf("Failed to forget missing images: %v", err)
+			return
+		}
+		for _, hash := range matched {
+			c.memory.Delete(hash)
+		}
+	}
+
+	log.Warnf("Forgot %d missing images totalling %s", forgottenItems, ByteCountIEC(forgottenSize))
+}
+
+// setEntry adds or modifies an entry in the database from a keyPair
+func (c *Cache) setEntry(keyPair KeyPair) error {
+	return c.database.Update(func(tx *bolt.Tx) error {
+		return c.setEntryInTx(tx, keyPair)
 	})
+}
+
+// setEntryInTx sets an entry within a transaction, moving its index entries and the totals along with it
+func (c *Cache) setEntryInTx(tx *bolt.Tx, keyPair KeyPair) error {
+	// Encode keyPair struct into bytes
+	keyPairBytes := encodeKeyPair(keyPair)
 
-	// Return error if any
-	return err
+	// Update database with encoded keyPair
+	previous, err := c.deleteIndexEntries(tx, keyPair.Key)
+	if err != nil {
+		return err
+	}
+	if err := writeBucket(tx, "KEYS").Put([]byte(keyPair.Key), keyPairBytes); err != nil {
+		return fmt.Errorf("could not set entry: %v", err)
+	}
+	if err := c.putIndexEntries(tx, keyPair); err != nil {
+		return err
+	}
+	if previous != nil {
+		return addTotals(tx, int64(keyPair.Size-previous.Size), 0)
+	}
+	return addTotals(tx, int64(keyPair.Size), 1)
 }
 
-func (c *Cache) Get(requestURI string) (reader *os.File, size int64, mtime time.Time, err error) {
+// Get returns the cached image for a key along with its entry
+func (c *Cache) Get(requestURI string) (StorageObject, KeyPair, error) {
 	// Check for empty cache key
 	if len(requestURI) == 0 {
-		return nil, 0, time.Now(), fmt.Errorf("empty cache key")
+		return nil, KeyPair{}, fmt.Errorf("empty cache key")
 	}
 
 	// Get cache key
 	hash := hashRequestURI(requestURI)
-	_, path := getPathFromHash(hash)
 
-	// Read image from directory
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, 0, time.Now(), fmt.Errorf("failed to read image from '%s': %v", path, err)
+	// Serve from memory if held there
+	if entry, ok := c.memory.Get(hash); ok {
+		c.recordHit(entry.keyPair)
+		return memoryReader{bytes.NewReader(entry.data)}, entry.keyPair, nil
 	}
 
-	// Get file information
-	fileInfo, err := os.Stat(path)
+	// Attempt to get keyPair
+	keyPair, err := c.getEntry(hash)
 	if err != nil {
-		return nil, 0, time.Now(), fmt.Errorf("failed to retrieve file information from '%s': %v", path, err)
+		return nil, KeyPair{}, fmt.Errorf("failed to get entry for cache key %s: %v", hash, err)
 	}
 
-	// Attempt to get keyPair
-	keyPair, err := c.getEntry(hash)
+	// Read image from storage, upgrading entries that lack its metadata
+	var object StorageObject
+	if keyPair.Version < keyPairVersion {
+		object, keyPair, err = c.upgradeEntry(requestURI, keyPair)
+	} else {
+		object, err = c.storage.Open(hash)
+	}
 	if err != nil {
-		return nil, 0, time.Now(), fmt.Errorf("failed to get entry for cache key %s: %v", path, err)
+		return nil, KeyPair{}, err
 	}
 
-	// If keyPair is older than configured cacheRefreshAge, refresh
-	if keyPair.Timestamp < time.Now().Add(-1*time.Duration(viper.GetInt("cache.refresh_age_seconds"))*time.Second).Unix() {
-		log.Debugf("Updating timestamp: %+v", keyPair)
-		if err != nil {
-			size := fileInfo.Size()
-			timestamp := time.Now().Unix()
-			keyPair = KeyPair{hash, timestamp, int(size)}
-		}
+	// Count hit, refreshing keyPair later if older than configured cacheRefreshAge
+	c.recordHit(keyPair)
 
-		// Update timestamp
-		keyPair.UpdateTimestamp()
+	// Copy image into memory if hot enough
+	object = c.memory.admitObject(object, keyPair)
 
-		// Set entry
-		err := c.setEntry(keyPair)
-		if err != nil {
-			return nil, 0, time.Now(), fmt.Errorf("failed to set entry for key %s: %v", requestURI, err)
-		}
+	// Return image
+	return object, keyPair, nil
+}
+
+// Open reads a cached image for the cache's own use, such as transcoding, without counting a hit
+func (c *Cache) Open(requestURI string) (StorageObject, error) {
+	// Check for entry
+	hash := hashRequestURI(requestURI)
+	if _, err := c.getEntry(hash); err != nil {
+		return nil, fmt.Errorf("failed to get entry for cache key %s: %v", hash, err)
+	}
+
+	// Read image from storage
+	return c.storage.Open(hash)
+}
+
+// upgradeEntry reads an image whose entry predates the current version, filling in the metadata the
+// entry lacks from storage and the request
+func (c *Cache) upgradeEntry(requestURI string, keyPair KeyPair) (StorageObject, KeyPair, error) {
+	object, info, err := c.storage.Get(keyPair.Key)
+	if err != nil {
+		return nil, keyPair, err
 	}
+	keyPair.Version = keyPairVersion
+	keyPair.URL = requestURI
+	keyPair.ContentType = getImageContentType(requestURI)
+	keyPair.LastModified = info.ModTime.Unix()
+	if err := c.setEntry(keyPair); err != nil {
+		object.Close()
+		return nil, keyPair, fmt.Errorf("failed to upgrade entry for key %s: %v", requestURI, err)
+	}
+	return object, keyPair, nil
+}
 
-	// Return file
-	return file, fileInfo.Size(), fileInfo.ModTime(), nil
+// isStale reports whether an entry's timestamp is older than the configured refresh age
+func (c *Cache) isStale(keyPair KeyPair) bool {
+	return keyPair.Timestamp < time.Now().Add(-1*time.Duration(viper.GetInt("cache.refresh_age_seconds"))*time.Second).Unix()
 }
 
-// Set takes a key, hashes it, and saves the `resp` bytearray into the corresponding file
+// Set takes a key, hashes it, and saves the `resp` bytearray into storage
 func (c *Cache) Set(requestURI string, mtime time.Time, resp []byte) error {
+	// Stream image into storage
+	writer, err := c.Create(requestURI)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	if _, err := writer.Write(resp); err != nil {
+		return fmt.Errorf("failed to write image for '%s': %v", requestURI, err)
+	}
+
+	// Commit image
+	return writer.Commit(mtime)
+}
+
+// CacheWriter streams an image into the cache, only making it visible once committed
+type CacheWriter struct {
+	cache       *Cache
+	requestURI  string
+	hash        string
+	contentType string
+	writer      StorageWriter
+	hasher      hash.Hash
+	size        int
+}
+
+// Create takes a key, hashes it, and returns a writer that streams an image into storage
+func (c *Cache) Create(requestURI string) (*CacheWriter, error) {
 	// Check for empty cache key
 	if len(requestURI) == 0 {
-		return fmt.Errorf("empty cache key")
+		return nil, fmt.Errorf("empty cache key")
 	}
 
 	// Get cache key
 	hash := hashRequestURI(requestURI)
-	parent, path := getPathFromHash(hash)
 
-	// Create necessary cache subfolder
-	if err := os.MkdirAll(parent, os.ModePerm); err != nil {
-		return fmt.Errorf("failed to create parent folder for '%s' at '%s': %v", requestURI, parent, err)
+	// Keep image out of the cache unless admitted, before anything is written
+	if !c.admit(hash) {
+		clientCacheRejectedTotal.Inc()
+		return nil, errNotAdmitted
 	}
+	clientCacheAdmittedTotal.Inc()
 
-	// Write image
-	if err := os.WriteFile(path, resp, 0644); err != nil {
-		return fmt.Errorf("failed to write image to disk for '%s' at '%s': %v", requestURI, path, err)
+	// Prepare storage writer
+	writer, err := c.storage.Put(hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare storage for '%s': %v", requestURI, err)
 	}
 
-	// Update modification time
-	if err := os.Chtimes(path, mtime, mtime); err != nil {
-		return fmt.Errorf("failed to set modification time of image '%s': %v", path, err)
+	// Return writer
+	return &CacheWriter{
+		cache:       c,
+		requestURI:  requestURI,
+		hash:        hash,
+		contentType: getImageContentType(requestURI),
+		writer:      writer,
+		hasher:      sha256.New(),
+	}, nil
+}
+
+// Write appends bytes to the uncommitted image
+func (w *CacheWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.hasher.Write(p[:n])
+	w.size += n
+	return n, err
+}
+
+// ReadAt reads back bytes that have already been written, even after the image is committed
+func (w *CacheWriter) ReadAt(p []byte, off int64) (int, error) {
+	return w.writer.ReadAt(p, off)
+}
+
+// SetContentType records the content type given by upstream in place of the one implied by the
+// extension, as long as it is an image type
+func (w *CacheWriter) SetContentType(contentType string) {
+	if strings.HasPrefix(contentType, "image/") {
+		w.contentType = contentType
 	}
+}
 
-	// Update database
-	size := len(resp)
-	timestamp := time.Now().Unix()
-	keyPair := KeyPair{hash, timestamp, size}
+// Checksum returns the hexadecimal SHA-256 of the bytes written so far
+func (w *CacheWriter) Checksum() string {
+	return hex.EncodeToString(w.hasher.Sum(nil))
+}
 
-	// Set database entry
-	if err := c.setEntry(keyPair); err != nil {
-		return fmt.Errorf("failed to write image to database of key '%s' at '%s' : %v", hash, path, err)
+// Commit makes the image visible in storage and records it in the database
+func (w *CacheWriter) Commit(mtime time.Time) error {
+	// Move image into place, dropping any stale copy from memory
+	if err := w.writer.Commit(mtime); err != nil {
+		return err
 	}
+	w.cache.memory.Delete(w.hash)
 
-	// Update Prometheus metrics
-	clientCacheSize.Add(size)
+	// Set database entry
+	keyPair := KeyPair{
+		Key:          w.hash,
+		Timestamp:    time.Now().Unix(),
+		Size:         w.size,
+		SHA256:       w.Checksum(),
+		Version:      keyPairVersion,
+		URL:          w.requestURI,
+		ContentType:  w.contentType,
+		LastModified: mtime.Unix(),
+	}
+	if writer, ok := w.writer.(*filesystemWriter); ok && writer.storage.isTiered() {
+		keyPair.Tier = writer.root.tier
+	}
+	w.cache.policy.Insert(&keyPair)
+	if err := w.cache.setEntry(keyPair); err != nil {
+		return fmt.Errorf("failed to write image to database of key '%s': %v", w.hash, err)
+	}
 
 	// Return no error
 	return nil
 }
 
+// Close releases the storage writer, discarding the image if it was never committed
+func (w *CacheWriter) Close() error {
+	return w.writer.Close()
+}
+
 // UpdateCacheLimit allows for updating of cache limit=
 func (c *Cache) UpdateCacheLimit(cacheLimit int) {
 	c.cacheLimitInBytes = cacheLimit
 	clientCacheLimit.Set(uint64(cacheLimit))
 }
 
-func (c *Cache) loadCacheInfo() (int, []KeyPair, error) {
-	// Create running variables
-	totalSize := 0
-
-	// Pull keys from BoltDB
-	keyPairs, err := c.Scan()
-	if err != nil {
-		log.Fatal(err)
+// loadCacheInfo scans every entry to correct the stored totals of the cache, the sizes of its roots and
+// the state of the eviction policy, returning the total size
+func (c *Cache) loadCacheInfo() (int, error) {
+	// Feed every entry to whatever keeps state about them
+	reconcilers := []reconciler{c.policy.Reconcile()}
+	if storage, ok := c.storage.(*filesystemStorage); ok {
+		reconcilers = append(reconcilers, storage.resetSizes())
 	}
 
-	// Count total size
-	for _, keyPair := range keyPairs {
-		totalSize += keyPair.Size
+	// Sum entries in the same transaction as the totals they should add up to
+	var totalSize, totalCount, storedSize, storedCount int64
+	counted := false
+	if err := c.database.View(func(tx *bolt.Tx) error {
+		counted = tx.Bucket([]byte("META")).Get([]byte("size")) != nil
+		storedSize, storedCount = getTotal(tx, "size"), getTotal(tx, "count")
+		cur := tx.Bucket([]byte("KEYS")).Cursor()
+		for key, keyPairBytes := cur.First(); key != nil; key, keyPairBytes = cur.Next() {
+			keyPair, err := decodeKeyPair(key, keyPairBytes)
+			if err != nil {
+				return err
+			}
+			for _, r := range reconcilers {
+				r.Add(keyPair)
+			}
+			totalSize += int64(keyPair.Size)
+			totalCount++
+		}
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("failed to scan entries: %v", err)
+	}
+	for _, r := range reconcilers {
+		r.Finish()
 	}
 
-	// Sort cache by access time
-	sort.Sort(ByTimestamp(keyPairs))
+	// Correct totals by how far they drifted, leaving changes made since the scan intact
+	if !counted || totalSize != storedSize || totalCount != storedCount {
+		if counted {
+			log.Warnf("Correcting cache totals from %s in %d entries to %s in %d entries", ByteCountIEC(int(storedSize)), storedCount, ByteCountIEC(int(totalSize)), totalCount)
+		}
+		if err := c.database.Update(func(tx *bolt.Tx) error {
+			return setTotals(tx, getTotal(tx, "size")+totalSize-storedSize, getTotal(tx, "count")+totalCount-storedCount)
+		}); err != nil {
+			return 0, fmt.Errorf("failed to correct totals: %v", err)
+		}
+	}
 
 	// Return running variables
-	return totalSize, keyPairs, err
+	return int(totalSize), nil
 }
 
-func (c *Cache) StartCompanionThread(keys []KeyPair) {
+func (c *Cache) StartCompanionThread() {
 	for {
 		// Sleep for 15 seconds before continuing
 		time.Sleep(15 * time.Second)
@@ -250,70 +522,100 @@ func (c *Cache) StartCompanionThread(keys []KeyPair) {
 		deletedItems := 0
 		startTime := time.Now()
 
-		// Loop over keys and delete till we are under threshold
-		for {
-			// Pop key
-			v := keys[0]
-			keys = keys[1:]
-
-			// Delete file
-			err := c.DeleteFileByKey(v.Key)
-			if err != nil {
-				log.Warnf("Unable to delete file in key '%s': %v", v.Key, err)
+		// Evict keys in the order of the eviction policy till we are under threshold
+		for int(clientCacheSize.Get()) >= c.cacheLimitInBytes && time.Since(startTime).Seconds() <= float64(viper.GetInt("cache.max_scan_time_seconds")) {
+			// Offer up a batch of victims, starting over from the beginning if there are none where the policy starts
+			seen := 0
+			evict := func(keyPair KeyPair) bool {
+				seen++
+				if c.evict(keyPair) {
+					clientCacheEvicted.Add(keyPair.Size)
+					deletedSize += keyPair.Size
+					deletedItems++
+				}
+
+				// Check if we are under threshold
+				if int(clientCacheSize.Get()) < c.cacheLimitInBytes {
+					return false
+				}
+
+				// Check batch size and time elapsed
+				return seen < accessBatchSize && time.Since(startTime).Seconds() <= float64(viper.GetInt("cache.max_scan_time_seconds"))
 			}
-
-			// Add to deletedSize
-			clientCacheSize.Add(-1 * v.Size)
-			clientCacheEvicted.Add(v.Size)
-			deletedSize += v.Size
-			deletedItems++
-
-			// Check if we are under threshold
-			if int(clientCacheSize.Get()) < c.cacheLimitInBytes {
+			start := c.policy.Start(c.cacheLimitInBytes)
+			if err := c.forEachByEviction(start, evict); err != nil {
+				log.Errorf("Failed to evict images: %v", err)
 				break
 			}
-
-			// Check time elapsed
-			if timeElapsed := time.Since(startTime).Seconds(); timeElapsed > float64(viper.GetInt("cache.max_scan_time_seconds")) {
+			if seen == 0 && start != nil {
+				if err := c.forEachByEviction(nil, evict); err != nil {
+					log.Errorf("Failed to evict images: %v", err)
+					break
+				}
+			}
+			if seen == 0 {
 				break
 			}
 		}
+		log.Debugf("Evicted %d images totalling %s in %s", deletedItems, ByteCountIEC(deletedSize), time.Since(startTime))
 	}
 }
 
-func (c *Cache) StartBackgroundThread() {
-	var keys []KeyPair
+// evict deletes an entry if the eviction policy agrees, otherwise writing back its updated stats, and
+// reports whether it was deleted
+func (c *Cache) evict(keyPair KeyPair) bool {
+	// Keep entries that were hit since their stats were last written
+	evicted := false
+	if hits := c.takeHits(keyPair.Key); hits > 0 {
+		keyPair.HitCount += int64(hits)
+		c.policy.Hit(&keyPair, hits)
+		keyPair.UpdateTimestamp()
+	} else {
+		evicted = c.policy.Evict(&keyPair)
+	}
 
-	// Rescan every scan interval for fresh keys
-	companionRunning := false
-	for {
-		// Retrieve cache information
-		var err error
-		var size int
-		if size, keys, err = c.loadCacheInfo(); err != nil {
-			log.Fatal(err)
+	// Delete file
+	if evicted {
+		if err := c.DeleteFileByKey(keyPair.Key); err != nil {
+			log.Warnf("Unable to delete file in key '%s': %v", keyPair.Key, err)
 		}
+		return true
+	}
 
-		// Update Prometheus metrics
-		if size > 0 {
-			clientCacheSize.Set(uint64(size))
-		}
+	// Otherwise reinsert with updated stats
+	if err := c.setEntry(keyPair); err != nil {
+		log.Warnf("Unable to update entry of key '%s': %v", keyPair.Key, err)
+	}
+	c.memory.Touch(keyPair)
+	return false
+}
+
+func (c *Cache) StartBackgroundThread() {
+	// Evict against the stored totals straight away
+	go c.StartCompanionThread()
 
-		// If partner thread not running, run now
-		if !companionRunning {
-			go c.StartCompanionThread(keys)
-			companionRunning = true
+	// Rescan every scan interval to reconcile the totals
+	for {
+		if _, err := c.loadCacheInfo(); err != nil {
+			log.Fatal(err)
 		}
 
 		// Sleep till next execution
 		time.Sleep(viper.GetDuration("cache.max_scan_interval_seconds") * time.Second)
 	}
-
 }
 
-// Close closes the database
+// Close writes back pending hits and closes the database, doing nothing if already closed
 func (c *Cache) Close() {
-	c.database.Close()
+	c.flushHits(true)
+
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+		c.database.Close()
+	}
 }
 
 // getEntry retrieves an entry from the database from a key
@@ -329,9 +631,9 @@ func (c *Cache) getEntry(hash string) (KeyPair, error) {
 			return fmt.Errorf("key does not exist")
 		}
 
-		// Unmarshal keyPairBytes into previously declared keyPair
-		err := json.Unmarshal(keyPairBytes, &keyPair)
-		if err != nil {
+		// Decode keyPairBytes into previously declared keyPair
+		var err error
+		if keyPair, err = decodeKeyPair([]byte(hash), keyPairBytes); err != nil {
 			return err
 		}
 
@@ -361,11 +663,8 @@ func (c *Cache) Scan() ([]KeyPair, error) {
 		// Cursor
 		cur := b.Cursor()
 		for key, keyPairBytes := cur.First(); key != nil; key, keyPairBytes = cur.Next() {
-			// Prepare empty keyPair struct
-			var keyPair KeyPair
-
-			// Unmarshal bytes
-			err := json.Unmarshal(keyPairBytes, &keyPair)
+			// Decode bytes
+			keyPair, err := decodeKeyPair(key, keyPairBytes)
 			if err != nil {
 				return err
 			}
@@ -422,7 +721,7 @@ func (c *Cache) Shrink() error {
 	}
 
 	// Attempt to compact database
-	if err = bolt.Compact(newDB, c.database, 0); err != nil {
+	if err = bolt.Compact(newDB, c.database.db, 0); err != nil {
 		log.Fatalf("failed to compact database: %v", err)
 	}
 
@@ -457,16 +756,38 @@ func (c *Cache) Setup() (err error) {
 		return fmt.Errorf("could not create cache directory '%s': %v", viper.GetString("cache.directory"), err)
 	}
 
+	// Prepare storage backend
+	if c.storage, err = newStorage(); err != nil {
+		return fmt.Errorf("could not prepare storage: %v", err)
+	}
+	if storage, ok := c.storage.(*filesystemStorage); ok {
+		storage.onRootFailed = c.forgetKeys
+	}
+
+	// Prepare eviction policy
+	if c.policy, err = newEvictionPolicy(viper.GetString("cache.eviction_policy")); err != nil {
+		return err
+	}
+	registerPolicyMetrics(c.policy)
+
 	// Open BoltDB database
 	options := c.getOptions()
-	if c.database, err = bolt.Open(viper.GetString("cache.directory")+"/cache.db", 0600, options); err != nil {
+	if c.database, err = openCacheDatabase(viper.GetString("cache.directory")+"/cache.db", options); err != nil {
 		return fmt.Errorf("could not open database: %v", err)
 	}
 
 	// Create bucket if not exists
 	if err := c.database.Update(func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucketIfNotExists([]byte("KEYS")); err != nil {
-			return fmt.Errorf("could not create bucket: %v", err)
+		indexesExist := tx.Bucket([]byte("ACCESS")) != nil && tx.Bucket([]byte("EVICTION")) != nil
+		for _, bucket := range []string{"KEYS", "PAGES", "ACCESS", "EVICTION", "META"} {
+			if err := createBucket(tx, bucket); err != nil {
+				return fmt.Errorf("could not create bucket: %v", err)
+			}
+		}
+
+		// Indexes that had to be created are no longer complete
+		if !indexesExist {
+			return writeBucket(tx, "META").Delete([]byte("indexed"))
 		}
 
 		// Return with no errors
@@ -475,14 +796,31 @@ func (c *Cache) Setup() (err error) {
 		return fmt.Errorf("failed to craete bucket: %v", err)
 	}
 
+	// Build indexes for databases created before they existed or with another eviction policy
+	if err := c.buildIndexes(); err != nil {
+		return fmt.Errorf("failed to build indexes: %v", err)
+	}
+
+	// Publish stored totals
+	if err := c.loadTotals(); err != nil {
+		return fmt.Errorf("failed to load totals: %v", err)
+	}
+
 	// Database ready!
 	log.Infof("Database ready!")
 	return nil
 }
 
-func OpenCache(directory string, cacheLimit int) *Cache {
+// newCache prepares a cache without starting any of its threads
+func newCache(cacheLimit int) *Cache {
 	cache := Cache{
 		cacheLimitInBytes: cacheLimit,
+		memory:            newMemoryTier(),
+		hits:              make(map[string]int),
+		due:               make(map[string]struct{}),
+		flushRequests:     make(chan struct{}, 1),
+		done:              make(chan struct{}),
+		sketch:            newCountMinSketch(viper.GetInt("cache.admission.sketch_width")),
 	}
 
 	// Setup BoltDB
@@ -493,12 +831,33 @@ func OpenCache(directory string, cacheLimit int) *Cache {
 
 	// Prep metrics counter
 	clientCacheLimit.Set(uint64(cacheLimit))
+	return &cache
+}
+
+func OpenCache(directory string, cacheLimit int) *Cache {
+	cache := newCache(cacheLimit)
 
 	// Start background clean-up thread
 	if viper.GetDuration("cache.max_scan_interval_seconds") > 0 {
 		go cache.StartBackgroundThread()
 	}
 
+	// Start thread writing back hits
+	go cache.StartAccessThread()
+
+	// Start thread compacting fragmented database
+	if viper.GetInt("cache.compaction.check_interval_seconds") > 0 {
+		go cache.StartCompactionThread()
+	}
+
+	// Convert entries written before the binary encoding
+	go cache.migrateEncoding()
+
+	// Start tiering thread if there is a slow tier
+	if storage, ok := cache.storage.(*filesystemStorage); ok && storage.isTiered() {
+		go cache.StartTieringThread(storage)
+	}
+
 	// Return cache object
-	return &cache
+	return cache
 }
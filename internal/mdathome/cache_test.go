@@ -0,0 +1,116 @@
+package mdathome
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// newTestCache opens a cache in a temporary directory without any of its background threads
+func newTestCache(t *testing.T, cacheLimit int) *Cache {
+	t.Helper()
+
+	// Use default configuration with a throwaway cache directory
+	setDefaultConfiguration()
+	viper.Set("cache.directory", t.TempDir())
+	t.Cleanup(func() {
+		viper.Set("cache.directory", nil)
+	})
+
+	c := newCache(cacheLimit)
+	t.Cleanup(c.Close)
+	return c
+}
+
+func TestOpenDoesNotCountHit(t *testing.T) {
+	c := newTestCache(t, 1<<30)
+	if err := c.Set("/data/x/0.png", time.Now(), []byte("image")); err != nil {
+		t.Fatalf("Failed to cache image: %v", err)
+	}
+
+	// Images read for the cache's own use are not hits
+	object, err := c.Open("/data/x/0.png")
+	if err != nil {
+		t.Fatalf("Failed to open image: %v", err)
+	}
+	defer object.Close()
+	if data, err := io.ReadAll(object); err != nil || string(data) != "image" {
+		t.Fatalf("Unexpected image %q: %v", data, err)
+	}
+	if hits := c.takeHits(hashRequestURI("/data/x/0.png")); hits != 0 {
+		t.Fatalf("Expected no hits, got %d", hits)
+	}
+
+	// Images served are
+	object, _, err = c.Get("/data/x/0.png")
+	if err != nil {
+		t.Fatalf("Failed to get image: %v", err)
+	}
+	object.Close()
+	if hits := c.takeHits(hashRequestURI("/data/x/0.png")); hits != 1 {
+		t.Fatalf("Expected a hit, got %d", hits)
+	}
+}
+
+func TestEntriesCarryMetadata(t *testing.T) {
+	c := newTestCache(t, 1<<30)
+	mtime := time.Unix(1700000000, 0)
+	image := []byte("image")
+	checksum := sha256.Sum256(image)
+
+	// Content types are taken from upstream only if they are image types
+	for requestURI, contentType := range map[string]string{"/data/x/0.png": "text/html", "/data/x/1.png": "image/webp"} {
+		writer, err := c.Create(requestURI)
+		if err != nil {
+			t.Fatalf("Failed to prepare image: %v", err)
+		}
+		writer.SetContentType(contentType)
+		writer.Write(image)
+		if err := writer.Commit(mtime); err != nil {
+			t.Fatalf("Failed to commit image: %v", err)
+		}
+		writer.Close()
+	}
+	for requestURI, contentType := range map[string]string{"/data/x/0.png": "image/png", "/data/x/1.png": "image/webp"} {
+		keyPair, err := c.getEntry(hashRequestURI(requestURI))
+		if err != nil {
+			t.Fatalf("Failed to get entry: %v", err)
+		}
+		if keyPair.Version != keyPairVersion || keyPair.URL != requestURI || keyPair.ContentType != contentType || keyPair.LastModified != mtime.Unix() || keyPair.Size != len(image) || keyPair.SHA256 != hex.EncodeToString(checksum[:]) {
+			t.Fatalf("Unexpected entry %+v", keyPair)
+		}
+	}
+
+	// Hits are counted into entries
+	object, _, err := c.Get("/data/x/0.png")
+	if err != nil {
+		t.Fatalf("Failed to get image: %v", err)
+	}
+	object.Close()
+	c.flushHits(true)
+	if keyPair, _ := c.getEntry(hashRequestURI("/data/x/0.png")); keyPair.HitCount != 1 {
+		t.Fatalf("Expected a hit to be counted, got %d", keyPair.HitCount)
+	}
+
+	// Entries predating metadata are filled in when next read
+	keyPair, _ := c.getEntry(hashRequestURI("/data/x/0.png"))
+	keyPair.Version, keyPair.URL, keyPair.ContentType, keyPair.LastModified = 0, "", "", 0
+	if err := c.setEntry(keyPair); err != nil {
+		t.Fatalf("Failed to downgrade entry: %v", err)
+	}
+	object, keyPair, err = c.Get("/data/x/0.png")
+	if err != nil {
+		t.Fatalf("Failed to get image: %v", err)
+	}
+	object.Close()
+	stored, _ := c.getEntry(keyPair.Key)
+	for _, keyPair := range []KeyPair{keyPair, stored} {
+		if keyPair.Version != keyPairVersion || keyPair.URL != "/data/x/0.png" || keyPair.ContentType != "image/png" || keyPair.LastModified != mtime.Unix() {
+			t.Fatalf("Expected entry to be upgraded, got %+v", keyPair)
+		}
+	}
+}
@@ -1,7 +1,12 @@
 package mdathome
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
 	"crypto/tls"
+	"fmt"
+	"math/big"
 	"sync"
 )
 
@@ -23,10 +28,52 @@ func (ch *certificateHandler) updateCertificate(cert tls.Certificate) error {
 	return nil
 }
 
+// wipeCertificate zeroes the private key held in memory and stops serving the certificate
+func (ch *certificateHandler) wipeCertificate() {
+	ch.certMu.Lock()
+	defer ch.certMu.Unlock()
+
+	// Zero private key material in place
+	if ch.cert != nil {
+		switch key := ch.cert.PrivateKey.(type) {
+		case *rsa.PrivateKey:
+			zeroBigInt(key.D)
+			for _, prime := range key.Primes {
+				zeroBigInt(prime)
+			}
+			zeroBigInt(key.Precomputed.Dp)
+			zeroBigInt(key.Precomputed.Dq)
+			zeroBigInt(key.Precomputed.Qinv)
+		case *ecdsa.PrivateKey:
+			zeroBigInt(key.D)
+		case ed25519.PrivateKey:
+			for i := range key {
+				key[i] = 0
+			}
+		}
+		ch.cert.PrivateKey = nil
+	}
+	ch.cert = nil
+}
+
+func zeroBigInt(n *big.Int) {
+	if n == nil {
+		return
+	}
+	words := n.Bits()
+	for i := range words {
+		words[i] = 0
+	}
+	n.SetInt64(0)
+}
+
 func (ch *certificateHandler) GetCertificate() func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
 	return func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 		ch.certMu.RLock()
 		defer ch.certMu.RUnlock()
+		if ch.cert == nil {
+			return nil, fmt.Errorf("no certificate available")
+		}
 		return ch.cert, nil
 	}
 }
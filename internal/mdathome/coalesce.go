@@ -0,0 +1,339 @@
+package mdathome
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var upstreamFetches = newFetchGroup()
+
+// fetchGroup coalesces concurrent upstream fetches of the same image into one
+type fetchGroup struct {
+	mu      sync.Mutex
+	fetches map[string]*upstreamFetch
+}
+
+func newFetchGroup() *fetchGroup {
+	return &fetchGroup{
+		fetches: make(map[string]*upstreamFetch),
+	}
+}
+
+// Join returns the in-flight fetch for an image path, starting a new one if none exists.
+// The returned boolean is true if an already running fetch was joined. Callers
+// must call Release on the fetch once they are done reading from it.
+func (g *fetchGroup) Join(key string) (*upstreamFetch, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// Join existing fetch if there is one
+	if fetch, ok := g.fetches[key]; ok {
+		fetch.acquire()
+		return fetch, true
+	}
+
+	// Otherwise start a new fetch, holding one reference for the caller and one for the download itself
+	fetch := newUpstreamFetch(key)
+	fetch.acquire()
+	fetch.acquire()
+	g.fetches[key] = fetch
+	go func() {
+		fetch.run()
+
+		// Stop accepting new readers once the image has been committed
+		g.mu.Lock()
+		delete(g.fetches, key)
+		g.mu.Unlock()
+		fetch.Release()
+	}()
+
+	return fetch, false
+}
+
+// fetchSpool holds the body of an upstream fetch while it is being shared
+type fetchSpool interface {
+	io.Writer
+	io.ReaderAt
+	io.Closer
+}
+
+// memorySpool is used in place of a cache writer when the image cannot be written to disk
+type memorySpool struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+func (s *memorySpool) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = append(s.data, p...)
+	return len(p), nil
+}
+
+func (s *memorySpool) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if off >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	return copy(p, s.data[off:]), nil
+}
+
+func (s *memorySpool) Close() error {
+	return nil
+}
+
+// upstreamFetch is a single upstream download shared by every reader of the same image
+type upstreamFetch struct {
+	key string
+
+	// Response information, only valid once ready is closed
+	ready      chan struct{}
+	upstream   string
+	transcoded bool
+	err        error
+	status     int
+	header     http.Header
+	modTime    time.Time
+
+	// Body received so far, guarded by mu
+	mu      sync.Mutex
+	cond    *sync.Cond
+	spool   fetchSpool
+	written int64
+	visible int64
+	done    bool
+	fail    error
+	refs    int
+}
+
+func newUpstreamFetch(key string) *upstreamFetch {
+	fetch := &upstreamFetch{
+		key:      key,
+		upstream: key,
+		ready:    make(chan struct{}),
+	}
+	fetch.cond = sync.NewCond(&fetch.mu)
+	return fetch
+}
+
+// acquire adds a reference to the fetch, keeping its spool open
+func (f *upstreamFetch) acquire() {
+	f.mu.Lock()
+	f.refs++
+	f.mu.Unlock()
+}
+
+// Release drops a reference to the fetch, closing its spool once nobody needs it
+func (f *upstreamFetch) Release() {
+	f.mu.Lock()
+	f.refs--
+	spool := f.spool
+	last := f.refs == 0
+	f.mu.Unlock()
+
+	if last && spool != nil {
+		if err := spool.Close(); err != nil {
+			log.Warnf("Failed to close upstream fetch of %s: %v", f.key, err)
+		}
+	}
+}
+
+// Wait blocks until upstream has responded, returning an error if the request failed
+func (f *upstreamFetch) Wait() error {
+	<-f.ready
+	return f.err
+}
+
+// NewReader returns a reader that yields the body received so far, then the rest as it arrives
+func (f *upstreamFetch) NewReader() io.Reader {
+	return &fetchReader{fetch: f}
+}
+
+func (f *upstreamFetch) run() {
+	// Generate locally from a cached original where possible
+	if f.transcode() {
+		return
+	}
+
+	// Send request
+	resp, err := fetchUpstream(f.key)
+	if err != nil {
+		f.err = err
+		f.finish(err)
+		close(f.ready)
+		return
+	}
+	defer resp.Body.Close()
+
+	// Prepare logger
+	f.upstream = resp.Request.URL.String()
+	log := log.WithFields(logrus.Fields{"type": "upstream", "upstream": f.upstream})
+
+	// Record response information
+	f.status = resp.StatusCode
+	f.header = resp.Header
+	f.modTime = time.Now()
+	if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+		if upstreamModTime, err := time.Parse(http.TimeFormat, lastModified); err == nil {
+			f.modTime = upstreamModTime
+		} else if seconds, err := strconv.Atoi(lastModified); err == nil && seconds > 0 {
+			f.modTime = time.Unix(int64(seconds), 0)
+		}
+	}
+
+	// Nothing to share if not 200
+	if resp.StatusCode != http.StatusOK {
+		f.finish(nil)
+		close(f.ready)
+		return
+	}
+
+	// Read start of body, refusing to share anything that is not the image asked for
+	validate := viper.GetBool("security.validate_upstream_images")
+	buf := make([]byte, 32*1024)
+	n, readErr := io.ReadAtLeast(resp.Body, buf, magicBytesLength)
+	if readErr == io.ErrUnexpectedEOF {
+		readErr = io.EOF
+	}
+	if readErr == nil || readErr == io.EOF {
+		if validate {
+			if err := checkMagicBytes(f.key, buf[:n]); err != nil {
+				log.WithFields(logrus.Fields{"event": "rejected", "error": err}).Warnf("Upstream fetch of %s rejected: %v", f.key, err)
+				readErr = err
+			}
+		}
+	}
+	if readErr != nil && readErr != io.EOF {
+		f.err = readErr
+		f.finish(readErr)
+		close(f.ready)
+		return
+	}
+
+	// Stream straight into the cache, falling back to memory if the cache cannot be written to
+	var spool fetchSpool = &memorySpool{}
+	writer, err := cache.Create(f.key)
+	if errors.Is(err, errNotAdmitted) {
+		log.WithFields(logrus.Fields{"event": "not_admitted"}).Debugf("Upstream fetch of %s not admitted into cache", f.key)
+	} else if err != nil {
+		log.WithFields(logrus.Fields{"event": "failed", "error": err}).Warnf("Failed to prepare cache for %s: %v", f.key, err)
+	} else {
+		writer.SetContentType(resp.Header.Get("Content-Type"))
+		spool = writer
+	}
+	f.mu.Lock()
+	f.spool = spool
+	f.mu.Unlock()
+	close(f.ready)
+
+	// Stream body into spool, waking readers as data arrives
+	for {
+		if n > 0 {
+			if _, err := f.spool.Write(buf[:n]); err != nil {
+				log.WithFields(logrus.Fields{"event": "failed", "error": err}).Warnf("Failed to spool %s: %v", f.key, err)
+				f.finish(err)
+				return
+			}
+
+			// Only expose the previous chunk to readers, so that a rejected payload is never served in full
+			f.mu.Lock()
+			f.visible = f.written
+			f.written += int64(n)
+			f.cond.Broadcast()
+			f.mu.Unlock()
+		}
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			log.WithFields(logrus.Fields{"event": "failed", "error": readErr}).Warnf("Upstream fetch of %s failed: %v", f.key, readErr)
+			f.finish(readErr)
+			return
+		}
+		n, readErr = resp.Body.Read(buf)
+	}
+
+	// Validate payload before it can be committed
+	if validate && writer != nil {
+		if err := checkPayload(f.key, f.written, resp.ContentLength, writer.Checksum()); err != nil {
+			log.WithFields(logrus.Fields{"event": "rejected", "error": err}).Warnf("Upstream fetch of %s rejected: %v", f.key, err)
+			f.finish(err)
+			return
+		}
+	}
+	f.finish(nil)
+
+	// Commit image to cache
+	if writer == nil {
+		return
+	}
+	if err := writer.Commit(f.modTime); err != nil {
+		log.WithFields(logrus.Fields{"event": "failed", "error": err}).Warnf("Failed to save %s: %v", f.key, err)
+		return
+	}
+	log.WithFields(logrus.Fields{"event": "committed", "image_length": f.written}).Debugf("Upstream fetch of %s committed with size %d bytes", f.key, f.written)
+
+	// Remember originals that `data-saver` images can be transcoded from
+	if viper.GetBool("transcode.enabled") && strings.HasPrefix(f.key, "/data/") {
+		if err := cache.setPage(f.key); err != nil {
+			log.WithFields(logrus.Fields{"event": "failed", "error": err}).Warnf("Failed to record page of %s: %v", f.key, err)
+		}
+	}
+}
+
+// finish marks the fetch as complete and wakes up all readers, exposing the rest of the body if successful
+func (f *upstreamFetch) finish(err error) {
+	f.mu.Lock()
+	f.done = true
+	f.fail = err
+	if err == nil {
+		f.visible = f.written
+	}
+	f.cond.Broadcast()
+	f.mu.Unlock()
+}
+
+// fetchReader reads from an upstreamFetch at its own offset
+type fetchReader struct {
+	fetch  *upstreamFetch
+	offset int64
+}
+
+func (r *fetchReader) Read(p []byte) (int, error) {
+	f := r.fetch
+
+	// Wait for more data to arrive
+	f.mu.Lock()
+	for r.offset >= f.visible && !f.done {
+		f.cond.Wait()
+	}
+	available, fail := f.visible-r.offset, f.fail
+	f.mu.Unlock()
+
+	// Return available data first
+	if available > 0 {
+		if int64(len(p)) > available {
+			p = p[:available]
+		}
+		n, err := f.spool.ReadAt(p, r.offset)
+		r.offset += int64(n)
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		return n, err
+	}
+
+	// Otherwise report how the fetch ended
+	if fail != nil {
+		return 0, fail
+	}
+	return 0, io.EOF
+}
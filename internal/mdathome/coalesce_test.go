@@ -0,0 +1,97 @@
+package mdathome
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testImage is a payload passing the magic bytes check of `.png` images
+var testImage = append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte("image"), 20000)...)
+
+// newTestUpstream makes a handler the only upstream, fetching into a test cache
+func newTestUpstream(t *testing.T, handler http.HandlerFunc) *Cache {
+	t.Helper()
+	c := newTestCache(t, 1<<30)
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	previousClient, previousCache, previousUpstreams := client, cache, upstreams
+	client, cache, upstreams = server.Client(), c, &upstreamPool{}
+	upstreams.Update(server.URL)
+	t.Cleanup(func() {
+		for _, m := range upstreams.members {
+			m.unregister()
+		}
+		client, cache, upstreams = previousClient, previousCache, previousUpstreams
+	})
+	return c
+}
+
+func TestConcurrentMissesFetchOnce(t *testing.T) {
+	// Hold upstream response until every reader joined
+	var requests atomic.Int32
+	release := make(chan struct{})
+	c := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		w.Write(testImage)
+	})
+
+	// Every reader joins the same fetch
+	group := newFetchGroup()
+	fetches := make([]*upstreamFetch, 8)
+	for i := range fetches {
+		fetch, joined := group.Join("/data/x/0.png")
+		if joined != (i > 0) {
+			t.Fatalf("Expected reader %d to join an existing fetch: %v", i, joined)
+		}
+		fetches[i] = fetch
+	}
+	close(release)
+
+	// Every reader gets the whole image from one upstream request
+	var wg sync.WaitGroup
+	for i, fetch := range fetches {
+		wg.Add(1)
+		go func(i int, fetch *upstreamFetch) {
+			defer wg.Done()
+			defer fetch.Release()
+			if err := fetch.Wait(); err != nil {
+				t.Errorf("Reader %d failed to fetch: %v", i, err)
+				return
+			}
+			if data, err := io.ReadAll(fetch.NewReader()); err != nil || !bytes.Equal(data, testImage) {
+				t.Errorf("Reader %d read %d bytes of image: %v", i, len(data), err)
+			}
+		}(i, fetch)
+	}
+	wg.Wait()
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("Expected a single upstream request, got %d", n)
+	}
+	if fetches[0] != fetches[len(fetches)-1] {
+		t.Fatalf("Expected readers to share a fetch")
+	}
+
+	// Image is committed once the fetch leaves the group
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		group.mu.Lock()
+		running := len(group.fetches)
+		group.mu.Unlock()
+		if running == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected fetch to finish")
+		}
+	}
+	if _, err := c.getEntry(hashRequestURI("/data/x/0.png")); err != nil {
+		t.Fatalf("Expected image to be committed: %v", err)
+	}
+}
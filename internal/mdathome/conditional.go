@@ -0,0 +1,73 @@
+package mdathome
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var imageHashRegexp = regexp.MustCompile(`^[^-]+-([0-9a-f]{64})\.[a-z]+$`)
+
+// getFilenameHash returns the SHA-256 embedded in an image filename, or an empty string if there is none
+func getFilenameHash(imageFilename string) string {
+	if matches := imageHashRegexp.FindStringSubmatch(imageFilename); matches != nil {
+		return matches[1]
+	}
+	return ""
+}
+
+// getImageETag returns a strong ETag for an image, preferring the SHA-256 embedded in `data` filenames
+func getImageETag(imageType string, imageFilename string, checksum string) string {
+	// Upstream only guarantees filename hashes for `data` images
+	if imageType == "data" {
+		if filenameHash := getFilenameHash(imageFilename); filenameHash != "" {
+			return `"` + filenameHash + `"`
+		}
+	}
+
+	// Otherwise fall back to the checksum computed when the image was cached
+	if checksum != "" {
+		return `"` + checksum + `"`
+	}
+	return ""
+}
+
+// etagMatches reports whether any entity tag in an If-None-Match header matches using weak comparison
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNotModified evaluates If-None-Match and If-Modified-Since against an image's validators.
+// An empty etag or zero modTime means that validator is unknown and cannot match.
+func checkNotModified(r *http.Request, etag string, modTime time.Time) bool {
+	// Conditional requests only apply to GET and HEAD
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etag != "" && etagMatches(ifNoneMatch, etag)
+	}
+
+	// Compare If-Modified-Since at the one-second resolution of HTTP dates
+	if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" && !modTime.IsZero() {
+		since, err := http.ParseTime(ifModifiedSince)
+		if err != nil {
+			return false
+		}
+		return !modTime.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
@@ -0,0 +1,68 @@
+package mdathome
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckNotModified(t *testing.T) {
+	etag := `"` + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef" + `"`
+	modTime := time.Date(2023, 11, 14, 22, 13, 20, 500000000, time.UTC)
+	date := modTime.Format(http.TimeFormat)
+	later := modTime.Add(time.Hour).Format(http.TimeFormat)
+	earlier := modTime.Add(-time.Hour).Format(http.TimeFormat)
+
+	for _, test := range []struct {
+		name     string
+		method   string
+		header   map[string]string
+		etag     string
+		modTime  time.Time
+		expected bool
+	}{
+		{"unconditional", http.MethodGet, nil, etag, modTime, false},
+		{"matching etag", http.MethodGet, map[string]string{"If-None-Match": etag}, etag, modTime, true},
+		{"weak matching etag", http.MethodGet, map[string]string{"If-None-Match": "W/" + etag}, etag, modTime, true},
+		{"matching etag in list", http.MethodGet, map[string]string{"If-None-Match": `"other", ` + etag}, etag, modTime, true},
+		{"any etag", http.MethodGet, map[string]string{"If-None-Match": "*"}, etag, modTime, true},
+		{"other etag", http.MethodGet, map[string]string{"If-None-Match": `"other"`}, etag, modTime, false},
+		{"unknown etag", http.MethodGet, map[string]string{"If-None-Match": etag}, "", modTime, false},
+		{"etag over date", http.MethodGet, map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": later}, etag, modTime, false},
+		{"same date", http.MethodGet, map[string]string{"If-Modified-Since": date}, etag, modTime, true},
+		{"later date", http.MethodGet, map[string]string{"If-Modified-Since": later}, etag, modTime, true},
+		{"earlier date", http.MethodGet, map[string]string{"If-Modified-Since": earlier}, etag, modTime, false},
+		{"unknown date", http.MethodGet, map[string]string{"If-Modified-Since": later}, etag, time.Time{}, false},
+		{"malformed date", http.MethodGet, map[string]string{"If-Modified-Since": "yesterday"}, etag, modTime, false},
+		{"head", http.MethodHead, map[string]string{"If-None-Match": etag}, etag, modTime, true},
+		{"post", http.MethodPost, map[string]string{"If-None-Match": etag}, etag, modTime, false},
+	} {
+		r := httptest.NewRequest(test.method, "/data/x/0.png", nil)
+		for key, value := range test.header {
+			r.Header.Set(key, value)
+		}
+		if notModified := checkNotModified(r, test.etag, test.modTime); notModified != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, notModified)
+		}
+	}
+}
+
+func TestGetImageETag(t *testing.T) {
+	hash := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	for _, test := range []struct {
+		imageType string
+		filename  string
+		checksum  string
+		expected  string
+	}{
+		{"data", "x1-" + hash + ".png", "checksum", `"` + hash + `"`},
+		{"data", "x1.png", "checksum", `"checksum"`},
+		{"data-saver", "x1-" + hash + ".jpg", "checksum", `"checksum"`},
+		{"data-saver", "x1-" + hash + ".jpg", "", ""},
+	} {
+		if etag := getImageETag(test.imageType, test.filename, test.checksum); etag != test.expected {
+			t.Errorf("%s/%s: expected %s, got %s", test.imageType, test.filename, test.expected, etag)
+		}
+	}
+}
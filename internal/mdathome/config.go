@@ -12,6 +12,8 @@ func setDefaultConfiguration() {
 	viper.SetDefault("client.control_server", "https://api.mangadex.network")
 	viper.SetDefault("client.graceful_shutdown_seconds", 300)
 	viper.SetDefault("client.max_speed_kbps", 10000)
+	viper.SetDefault("client.paused_mode", PausedModeCacheOnly)
+	viper.SetDefault("client.paused_retry_after_seconds", 60)
 	viper.SetDefault("client.port", 443)
 	viper.SetDefault("client.secret", "")
 
@@ -21,12 +23,54 @@ func setDefaultConfiguration() {
 	viper.SetDefault("override.size", 0)
 	viper.SetDefault("override.upstream", "")
 
+	// [upstream]
+	viper.SetDefault("upstream.breaker_cooldown_seconds", 30)
+	viper.SetDefault("upstream.breaker_failure_threshold", 10)
+	viper.SetDefault("upstream.default_priority", 0)
+	viper.SetDefault("upstream.default_weight", 1)
+	viper.SetDefault("upstream.first_byte_timeout_seconds", 10)
+	viper.SetDefault("upstream.health_check_interval_seconds", 30)
+	viper.SetDefault("upstream.health_check_path", "/")
+	viper.SetDefault("upstream.health_check_timeout_seconds", 5)
+	viper.SetDefault("upstream.max_retries", 2)
+	viper.SetDefault("upstream.pool", []map[string]interface{}{})
+	viper.SetDefault("upstream.retry_base_delay_milliseconds", 100)
+	viper.SetDefault("upstream.retry_max_delay_milliseconds", 2000)
+
 	// [cache]
+	viper.SetDefault("cache.access_buffer_entries", 100000)
+	viper.SetDefault("cache.access_flush_entries", 1000)
+	viper.SetDefault("cache.access_flush_interval_seconds", 5)
+	viper.SetDefault("cache.admission.enabled", false)
+	viper.SetDefault("cache.admission.sketch_width", 262144)
+	viper.SetDefault("cache.admission.warmup_percent", 95)
+	viper.SetDefault("cache.admission.warmup_requests", 100000)
+	viper.SetDefault("cache.backend", StorageBackendFilesystem)
+	viper.SetDefault("cache.compaction.check_interval_seconds", 3600)
+	viper.SetDefault("cache.compaction.free_percent", 50)
+	viper.SetDefault("cache.compaction.min_size_mebibytes", 64)
 	viper.SetDefault("cache.directory", "cache/")
+	viper.SetDefault("cache.durability", CacheDurabilityFile)
+	viper.SetDefault("cache.eviction.lfu_half_life_seconds", 86400)
+	viper.SetDefault("cache.eviction.s3fifo_small_percent", 10)
+	viper.SetDefault("cache.eviction_policy", EvictionPolicyLRU)
 	viper.SetDefault("cache.max_scan_interval_seconds", 900)
 	viper.SetDefault("cache.max_scan_time_seconds", 300)
 	viper.SetDefault("cache.max_size_mebibytes", 10240)
+	viper.SetDefault("cache.memory_size_mebibytes", 0)
 	viper.SetDefault("cache.refresh_age_seconds", 86400)
+	viper.SetDefault("cache.roots", []map[string]interface{}{})
+	viper.SetDefault("cache.s3.access_key_id", "")
+	viper.SetDefault("cache.s3.bucket", "")
+	viper.SetDefault("cache.s3.endpoint", "")
+	viper.SetDefault("cache.s3.prefix", "")
+	viper.SetDefault("cache.s3.region", "us-east-1")
+	viper.SetDefault("cache.s3.secret_access_key", "")
+	viper.SetDefault("cache.s3.timeout_seconds", 30)
+	viper.SetDefault("cache.tiering.demote_after_seconds", 604800)
+	viper.SetDefault("cache.tiering.interval_seconds", 300)
+	viper.SetDefault("cache.tiering.migration_speed_kbps", 100000)
+	viper.SetDefault("cache.tiering.promote_after_hits", 3)
 
 	// [performance]
 	viper.SetDefault("performance.allow_http2", true)
@@ -35,13 +79,22 @@ func setDefaultConfiguration() {
 	viper.SetDefault("performance.upstream_connection_reuse", true)
 
 	// [security]
+	viper.SetDefault("security.admin_token", "")
 	viper.SetDefault("security.allow_visitor_cache_refresh", false)
 	viper.SetDefault("security.reject_invalid_hostname", false)
 	viper.SetDefault("security.reject_invalid_sni", false)
 	viper.SetDefault("security.reject_invalid_tokens", true)
 	viper.SetDefault("security.send_server_header", false)
 	viper.SetDefault("security.use_forwarded_for_headers", false)
+	viper.SetDefault("security.validate_upstream_images", true)
 	viper.SetDefault("security.verify_image_integrity", false)
+	viper.SetDefault("security.verify_image_integrity_sample_percent", 100)
+
+	// [transcode]
+	viper.SetDefault("transcode.enabled", false)
+	viper.SetDefault("transcode.jpeg_quality", 75)
+	viper.SetDefault("transcode.max_height_pixels", 0)
+	viper.SetDefault("transcode.max_width_pixels", 960)
 
 	// [metric]
 	viper.SetDefault("metrics.enable_prometheus", false)
@@ -13,4 +13,5 @@ const ClientSpecification int = 31
 const (
 	KeyCacheDirectory string = "cache.directory"
 	KeyCacheSize      string = "cache.max_size_mebibytes"
+	KeyMaxSpeed       string = "client.max_speed_kbps"
 )
@@ -0,0 +1,558 @@
+package mdathome
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+// compactionChunkSize is how many bytes of keys and values are copied into the compacted database per
+// transaction
+const compactionChunkSize = 4 * 1024 * 1024
+
+// compactionReplayRounds is how many times the journal is replayed while writes continue, before
+// writes are held back to replay the rest and swap databases
+const compactionReplayRounds = 3
+
+// errCompactionRunning is returned when compaction is requested while one is already running
+var errCompactionRunning = errors.New("compaction already running")
+
+// errDatabaseClosed is returned when the database is used after being closed, or after it could not
+// be reopened following compaction
+var errDatabaseClosed = errors.New("database closed")
+
+var (
+	clientCacheCompactionsTotal       = metrics.NewCounter("client_cache_compactions_total")
+	clientCacheCompactionsFailedTotal = metrics.NewCounter("client_cache_compactions_failed_total")
+)
+
+// journalingDatabases maps the handles of databases being compacted to the database journaling the
+// changes made to them
+var journalingDatabases sync.Map
+
+// cacheDatabase wraps the BoltDB database so that it can be compacted while in use. During compaction,
+// the keys changed by writes are journaled so that their values can be copied again before the
+// compacted copy replaces the database.
+type cacheDatabase struct {
+	path    string
+	options *bolt.Options
+
+	// Guards the handle, which is only swapped while holding it exclusively
+	mu     sync.RWMutex
+	db     *bolt.DB
+	closed bool
+
+	// Keys changed in each bucket since compaction started, and whether any bucket was created or deleted
+	journalMu      sync.Mutex
+	journal        map[string]map[string]struct{}
+	bucketsChanged bool
+
+	compacting atomic.Bool
+	closing    atomic.Bool
+}
+
+// openCacheDatabase opens the BoltDB database at a path
+func openCacheDatabase(path string, options *bolt.Options) (*cacheDatabase, error) {
+	db, err := bolt.Open(path, 0600, options)
+	if err != nil {
+		return nil, err
+	}
+	return &cacheDatabase{path: path, options: options, db: db}, nil
+}
+
+// View runs a read-only transaction
+func (d *cacheDatabase) View(fn func(*bolt.Tx) error) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return errDatabaseClosed
+	}
+	return d.db.View(fn)
+}
+
+// Update runs a read-write transaction. Changes must be made through writeBucket, createBucket and
+// deleteBucket so that they are journaled while the database is being compacted.
+func (d *cacheDatabase) Update(fn func(*bolt.Tx) error) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return errDatabaseClosed
+	}
+	return d.db.Update(fn)
+}
+
+// Batch runs a read-write transaction that may be combined with others, with changes made like for Update
+func (d *cacheDatabase) Batch(fn func(*bolt.Tx) error) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return errDatabaseClosed
+	}
+	return d.db.Batch(fn)
+}
+
+// record journals a key changed in a bucket, or a bucket created or deleted if key is nil
+func (d *cacheDatabase) record(bucket string, key []byte) {
+	d.journalMu.Lock()
+	defer d.journalMu.Unlock()
+	if d.journal == nil {
+		return
+	}
+	if key == nil {
+		d.bucketsChanged = true
+		return
+	}
+	keys, ok := d.journal[bucket]
+	if !ok {
+		keys = make(map[string]struct{})
+		d.journal[bucket] = keys
+	}
+	keys[string(key)] = struct{}{}
+}
+
+// recordChange journals a change made by a read-write transaction once committed, if its database is
+// being compacted. Journaling it any earlier could have it replayed before its value can be read.
+func recordChange(tx *bolt.Tx, bucket string, key []byte) {
+	d, ok := journalingDatabases.Load(tx.DB())
+	if !ok {
+		return
+	}
+	if key != nil {
+		key = bytes.Clone(key)
+	}
+	tx.OnCommit(func() {
+		d.(*cacheDatabase).record(bucket, key)
+	})
+}
+
+// journaledBucket is a bucket of a read-write transaction that journals the keys changed through it
+type journaledBucket struct {
+	*bolt.Bucket
+	tx   *bolt.Tx
+	name string
+}
+
+// writeBucket returns a bucket of a read-write transaction to make changes through
+func writeBucket(tx *bolt.Tx, name string) journaledBucket {
+	return journaledBucket{Bucket: tx.Bucket([]byte(name)), tx: tx, name: name}
+}
+
+func (b journaledBucket) Put(key []byte, value []byte) error {
+	if err := b.Bucket.Put(key, value); err != nil {
+		return err
+	}
+	recordChange(b.tx, b.name, key)
+	return nil
+}
+
+func (b journaledBucket) Delete(key []byte) error {
+	if err := b.Bucket.Delete(key); err != nil {
+		return err
+	}
+	recordChange(b.tx, b.name, key)
+	return nil
+}
+
+// createBucket creates a bucket unless it already exists
+func createBucket(tx *bolt.Tx, name string) error {
+	if tx.Bucket([]byte(name)) != nil {
+		return nil
+	}
+	if _, err := tx.CreateBucket([]byte(name)); err != nil {
+		return err
+	}
+	recordChange(tx, name, nil)
+	return nil
+}
+
+// deleteBucket deletes a bucket along with every key in it
+func deleteBucket(tx *bolt.Tx, name string) error {
+	if err := tx.DeleteBucket([]byte(name)); err != nil {
+		return err
+	}
+	recordChange(tx, name, nil)
+	return nil
+}
+
+// Close closes the database, abandoning any compaction in progress
+func (d *cacheDatabase) Close() error {
+	d.closing.Store(true)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	return d.db.Close()
+}
+
+// getFreePercent returns the size of the database and how much of it is free pages
+func (d *cacheDatabase) getFreePercent() (int64, int, error) {
+	var size int64
+	var pageSize int
+	if err := d.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		pageSize = tx.DB().Info().PageSize
+		return nil
+	}); err != nil {
+		return 0, 0, err
+	}
+	if size == 0 {
+		return 0, 0, nil
+	}
+
+	// Count free and pending pages against every page in the file
+	d.mu.RLock()
+	stats := d.db.Stats()
+	d.mu.RUnlock()
+	return size, int(int64(stats.FreePageN+stats.PendingPageN) * int64(pageSize) * 100 / size), nil
+}
+
+// compact copies the database into a new file while it is still used, copies keys changed meanwhile
+// again and then swaps the new file in
+func (d *cacheDatabase) compact() error {
+	// Prepare new database location
+	tmpPath := d.path + ".tmp"
+	if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove old compacted database: %v", err)
+	}
+	newDB, err := bolt.Open(tmpPath, 0600, d.options)
+	if err != nil {
+		return fmt.Errorf("could not open compacted database: %v", err)
+	}
+	swapped := false
+	defer func() {
+		if !swapped {
+			d.stopJournaling()
+			newDB.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	// Start journaling before anything is copied, while no writes are running
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return errDatabaseClosed
+	}
+	d.journalMu.Lock()
+	d.journal = make(map[string]map[string]struct{})
+	d.bucketsChanged = false
+	d.journalMu.Unlock()
+	journalingDatabases.Store(d.db, d)
+	d.mu.Unlock()
+
+	// Copy database
+	if err := d.copyDatabase(newDB); err != nil {
+		return err
+	}
+
+	// Catch up with writes while they continue
+	for i := 0; i < compactionReplayRounds; i++ {
+		if err := d.replayJournal(newDB, d.View); err != nil {
+			return err
+		}
+	}
+
+	// Hold writes back to replay the rest and swap databases
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return errDatabaseClosed
+	}
+	if err := d.replayJournal(newDB, d.db.View); err != nil {
+		return err
+	}
+	journalingDatabases.Delete(d.db)
+	if err := newDB.Close(); err != nil {
+		return fmt.Errorf("could not close compacted database: %v", err)
+	}
+	if err := d.db.Close(); err != nil {
+		return fmt.Errorf("could not close database: %v", err)
+	}
+	swapped = true
+	return d.replace(tmpPath)
+}
+
+// replace moves a database file into place of the closed database and opens it. If that fails, the
+// original file is restored and reopened, and if even that fails the database stays closed so that
+// every transaction fails. It must be called while holding the handle exclusively.
+func (d *cacheDatabase) replace(path string) error {
+	// Keep original file until the new one opened
+	backupPath := d.path + ".old"
+	if err := os.Rename(d.path, backupPath); err != nil {
+		os.Remove(path)
+		return d.reopen(fmt.Errorf("could not move database aside: %v", err))
+	}
+	if err := os.Rename(path, d.path); err != nil {
+		os.Remove(path)
+		return d.restore(backupPath, fmt.Errorf("could not replace database: %v", err))
+	}
+	db, err := bolt.Open(d.path, 0600, d.options)
+	if err != nil {
+		return d.restore(backupPath, fmt.Errorf("could not open compacted database: %v", err))
+	}
+	d.db = db
+	if err := os.Remove(backupPath); err != nil {
+		log.Warnf("Failed to remove original database after compaction: %v", err)
+	}
+	return nil
+}
+
+// restore moves the original database file back into place and reopens it
+func (d *cacheDatabase) restore(backupPath string, cause error) error {
+	if err := os.Rename(backupPath, d.path); err != nil {
+		d.closed = true
+		return fmt.Errorf("%v, and could not restore original database: %v", cause, err)
+	}
+	return d.reopen(cause)
+}
+
+// reopen opens the database file again after a failed swap, leaving the database closed if it cannot
+func (d *cacheDatabase) reopen(cause error) error {
+	db, err := bolt.Open(d.path, 0600, d.options)
+	if err != nil {
+		d.closed = true
+		return fmt.Errorf("%v, and could not reopen database: %v", cause, err)
+	}
+	d.db = db
+	return cause
+}
+
+// copyDatabase copies every bucket into another database a chunk at a time. Each chunk is read in its own
+// short transaction, as a long one would hold up writers that need to grow the database, so chunks may
+// see changes made since compaction started, which are copied again once replayed.
+func (d *cacheDatabase) copyDatabase(dst *bolt.DB) error {
+	// List buckets
+	var names [][]byte
+	if err := d.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			names = append(names, append([]byte(nil), name...))
+			return nil
+		})
+	}); err != nil {
+		return fmt.Errorf("could not list buckets: %v", err)
+	}
+
+	for _, name := range names {
+		if err := dst.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(name)
+			return err
+		}); err != nil {
+			return fmt.Errorf("could not create bucket %s: %v", name, err)
+		}
+
+		var after []byte
+		for {
+			// Give up if the database is closing
+			if d.closing.Load() {
+				return fmt.Errorf("database closing")
+			}
+
+			// Read next chunk, skipping buckets deleted since they were listed
+			var keys, values [][]byte
+			if err := d.View(func(tx *bolt.Tx) error {
+				bucket := tx.Bucket(name)
+				if bucket == nil {
+					return nil
+				}
+				cur := bucket.Cursor()
+
+				// Continue after last key of previous chunk
+				key, value := cur.First()
+				if after != nil {
+					if key, value = cur.Seek(after); bytes.Equal(key, after) {
+						key, value = cur.Next()
+					}
+				}
+
+				for size := 0; key != nil && size < compactionChunkSize; key, value = cur.Next() {
+					if value == nil {
+						return fmt.Errorf("nested bucket %s is not supported", key)
+					}
+					after = append(after[:0], key...)
+					keys = append(keys, append([]byte(nil), key...))
+					values = append(values, append([]byte(nil), value...))
+					size += len(key) + len(value)
+				}
+				return nil
+			}); err != nil {
+				return fmt.Errorf("could not read bucket %s: %v", name, err)
+			}
+			if len(keys) == 0 {
+				break
+			}
+
+			// Write chunk, packing pages as keys arrive in order
+			if err := dst.Update(func(tx *bolt.Tx) error {
+				bucket := tx.Bucket(name)
+				bucket.FillPercent = 1.0
+				for i, key := range keys {
+					if err := bucket.Put(key, values[i]); err != nil {
+						return err
+					}
+				}
+				return nil
+			}); err != nil {
+				return fmt.Errorf("could not copy bucket %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// replayJournal copies the current values of keys journaled so far into the compacted database, reading
+// them through view. Buckets created or deleted meanwhile cannot be caught up with, failing compaction.
+func (d *cacheDatabase) replayJournal(dst *bolt.DB, view func(func(*bolt.Tx) error) error) error {
+	d.journalMu.Lock()
+	journal, bucketsChanged := d.journal, d.bucketsChanged
+	d.journal = make(map[string]map[string]struct{})
+	d.journalMu.Unlock()
+	if bucketsChanged {
+		return fmt.Errorf("buckets were created or deleted during compaction")
+	}
+	if len(journal) == 0 {
+		return nil
+	}
+
+	// Read current values, where missing keys were deleted
+	values := make(map[string]map[string][]byte, len(journal))
+	if err := view(func(tx *bolt.Tx) error {
+		for name, keys := range journal {
+			bucket := tx.Bucket([]byte(name))
+			values[name] = make(map[string][]byte, len(keys))
+			for key := range keys {
+				var value []byte
+				if bucket != nil {
+					value = bytes.Clone(bucket.Get([]byte(key)))
+				}
+				values[name][key] = value
+			}
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("could not read changed keys: %v", err)
+	}
+
+	// Write them
+	if err := dst.Update(func(tx *bolt.Tx) error {
+		for name, keys := range values {
+			bucket, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+			for key, value := range keys {
+				if value == nil {
+					err = bucket.Delete([]byte(key))
+				} else {
+					err = bucket.Put([]byte(key), value)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("could not replay changed keys: %v", err)
+	}
+	return nil
+}
+
+// stopJournaling stops journaling changes and drops those journaled so far
+func (d *cacheDatabase) stopJournaling() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	journalingDatabases.Delete(d.db)
+	d.journalMu.Lock()
+	d.journal = nil
+	d.journalMu.Unlock()
+}
+
+// StartCompaction compacts the database in the background while the cache keeps being used
+func (c *Cache) StartCompaction() error {
+	if !c.database.compacting.CompareAndSwap(false, true) {
+		return errCompactionRunning
+	}
+	go func() {
+		defer c.database.compacting.Store(false)
+		c.compactDatabase()
+	}()
+	return nil
+}
+
+// compactDatabase compacts the database, logging how much it shrank
+func (c *Cache) compactDatabase() {
+	// Measure database before
+	sizeBefore, freePercent, err := c.database.getFreePercent()
+	if err != nil {
+		log.Errorf("Failed to measure database: %v", err)
+		return
+	}
+	log.Infof("Compacting database of %s with %d%% free pages...", ByteCountIEC(int(sizeBefore)), freePercent)
+
+	// Compact database
+	startTime := time.Now()
+	if err := c.database.compact(); err != nil {
+		clientCacheCompactionsFailedTotal.Inc()
+		log.Errorf("Failed to compact database: %v", err)
+		return
+	}
+	clientCacheCompactionsTotal.Inc()
+
+	// Measure database after
+	sizeAfter, _, err := c.database.getFreePercent()
+	if err != nil {
+		log.Errorf("Failed to measure database: %v", err)
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"type":        "compaction",
+		"size_before": sizeBefore,
+		"size_after":  sizeAfter,
+		"duration":    time.Since(startTime).Seconds(),
+	}).Infof("Compacted database from %s to %s in %s", ByteCountIEC(int(sizeBefore)), ByteCountIEC(int(sizeAfter)), time.Since(startTime).Round(time.Millisecond))
+}
+
+// StartCompactionThread compacts the database whenever enough of it is free pages, till the cache is
+// closed
+func (c *Cache) StartCompactionThread() {
+	ticker := time.NewTicker(time.Duration(viper.GetInt("cache.compaction.check_interval_seconds")) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+
+		// Check fragmentation
+		threshold := viper.GetInt("cache.compaction.free_percent")
+		if threshold <= 0 {
+			continue
+		}
+		size, freePercent, err := c.database.getFreePercent()
+		if err != nil {
+			log.Warnf("Failed to measure database: %v", err)
+			continue
+		}
+		if freePercent < threshold || size < int64(viper.GetInt("cache.compaction.min_size_mebibytes"))*1024*1024 {
+			continue
+		}
+
+		// Compact database
+		if err := c.StartCompaction(); err != nil {
+			log.Debugf("Skipping compaction: %v", err)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package mdathome
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestCompactionAlongsideWrites(t *testing.T) {
+	c := newTestCache(t, 1<<40)
+	newKeyPair := func(key string) KeyPair {
+		return KeyPair{Key: key, Timestamp: time.Now().Unix(), Size: 10, Version: keyPairVersion}
+	}
+
+	// Fragment database by deleting most of what was written
+	if err := c.database.Update(func(tx *bolt.Tx) error {
+		for i := 0; i < 5000; i++ {
+			if err := c.setEntryInTx(tx, newKeyPair(fmt.Sprintf("%032d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.database.Update(func(tx *bolt.Tx) error {
+		for i := 0; i < 4000; i++ {
+			if err := c.deleteEntryInTx(tx, fmt.Sprintf("%032d", i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(viper.GetString("cache.directory") + "/cache.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep adding, deleting and hitting entries while compacting
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	written := make([]int, 4)
+	for w := range written {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := fmt.Sprintf("w%d-%028d", w, n)
+				if err := c.setEntry(newKeyPair(key)); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := c.deleteEntry(fmt.Sprintf("%032d", 4000+w*250+n%250)); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := c.writeHits([]string{key}, map[string]int{key: 1}); err != nil {
+					t.Error(err)
+					return
+				}
+				written[w] = n + 1
+			}
+		}(w)
+	}
+	time.Sleep(20 * time.Millisecond)
+	err = c.database.compact()
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Database shrank without losing writes
+	after, err := os.Stat(viper.GetString("cache.directory") + "/cache.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= before.Size() {
+		t.Fatalf("expected database to shrink from %d bytes, got %d bytes", before.Size(), after.Size())
+	}
+	for w, n := range written {
+		if n == 0 {
+			t.Fatalf("writer %d made no writes", w)
+		}
+		for i := 0; i < n; i++ {
+			keyPair, err := c.getEntry(fmt.Sprintf("w%d-%028d", w, i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keyPair.HitCount != 1 {
+				t.Fatalf("expected 1 hit on entry %d of writer %d, got %d", i, w, keyPair.HitCount)
+			}
+		}
+	}
+
+	// Totals and indexes still add up, as no write was applied twice
+	if err := c.database.View(func(tx *bolt.Tx) error {
+		var size, count int64
+		cur := tx.Bucket([]byte("KEYS")).Cursor()
+		for key, keyPairBytes := cur.First(); key != nil; key, keyPairBytes = cur.Next() {
+			keyPair, err := decodeKeyPair(key, keyPairBytes)
+			if err != nil {
+				return err
+			}
+			size += int64(keyPair.Size)
+			count++
+		}
+		if size != getTotal(tx, "size") || count != getTotal(tx, "count") {
+			return fmt.Errorf("expected totals of %d bytes in %d entries, got %d bytes in %d entries", size, count, getTotal(tx, "size"), getTotal(tx, "count"))
+		}
+		if n := tx.Bucket([]byte("ACCESS")).Stats().KeyN; int64(n) != count {
+			return fmt.Errorf("expected %d access index entries, got %d", count, n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(viper.GetString("cache.directory") + "/cache.db.tmp"); !os.IsNotExist(err) {
+		t.Fatalf("expected compacted copy to be moved into place, got %v", err)
+	}
+}
+
+func TestJournalRecordsCommittedChanges(t *testing.T) {
+	c := newTestCache(t, 1<<40)
+	dst, err := bolt.Open(t.TempDir()+"/compacted.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	// Start journaling like compaction does
+	c.database.journal = make(map[string]map[string]struct{})
+	journalingDatabases.Store(c.database.db, c.database)
+	defer c.database.stopJournaling()
+
+	// Only committed changes are journaled
+	errRollback := errors.New("rollback")
+	if err := c.database.Update(func(tx *bolt.Tx) error {
+		if err := writeBucket(tx, "PAGES").Put([]byte("rolled back"), []byte("x")); err != nil {
+			return err
+		}
+		return errRollback
+	}); err != errRollback {
+		t.Fatal(err)
+	}
+	if err := c.database.Update(func(tx *bolt.Tx) error {
+		return writeBucket(tx, "PAGES").Put([]byte("committed"), []byte("x"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.database.journal["PAGES"]["rolled back"]; ok || len(c.database.journal["PAGES"]) != 1 {
+		t.Fatalf("expected only committed key to be journaled, got %v", c.database.journal)
+	}
+
+	// Replaying copies current values
+	if err := c.database.replayJournal(dst, c.database.View); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.View(func(tx *bolt.Tx) error {
+		if value := tx.Bucket([]byte("PAGES")).Get([]byte("committed")); string(value) != "x" {
+			return fmt.Errorf("expected replayed value, got %q", value)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Buckets recreated meanwhile cannot be caught up with
+	if err := c.database.Update(func(tx *bolt.Tx) error {
+		if err := deleteBucket(tx, "PAGES"); err != nil {
+			return err
+		}
+		return createBucket(tx, "PAGES")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.database.replayJournal(dst, c.database.View); err == nil {
+		t.Fatal("expected replay to fail after buckets changed")
+	}
+}
+
+func TestFailedSwapReopensOriginalDatabase(t *testing.T) {
+	c := newTestCache(t, 1<<40)
+	keyPair := KeyPair{Key: fmt.Sprintf("%032d", 1), Timestamp: time.Now().Unix(), Size: 10, Version: keyPairVersion}
+	if err := c.setEntry(keyPair); err != nil {
+		t.Fatal(err)
+	}
+
+	// Swap in a file that is not a database
+	tmpPath := c.database.path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte("not a database"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c.database.mu.Lock()
+	if err := c.database.db.Close(); err != nil {
+		c.database.mu.Unlock()
+		t.Fatal(err)
+	}
+	err := c.database.replace(tmpPath)
+	c.database.mu.Unlock()
+	if err == nil {
+		t.Fatal("expected swap to fail")
+	}
+
+	// Original database is still served
+	if _, err := c.getEntry(keyPair.Key); err != nil {
+		t.Fatalf("expected original database to be reopened, got %v", err)
+	}
+	for _, path := range []string{tmpPath, c.database.path + ".old"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed, got %v", path, err)
+		}
+	}
+}
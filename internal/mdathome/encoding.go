@@ -0,0 +1,234 @@
+package mdathome
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// keyPairEncodingBinary is the leading byte of binary encoded entries. Entries written as JSON
+// before it existed always start with '{' instead.
+const keyPairEncodingBinary = 1
+
+// encodingBatchSize is how many entries are converted to the binary encoding per transaction
+const encodingBatchSize = 10000
+
+// encodeKeyPair encodes an entry in the binary encoding, leaving out its key as the database already
+// holds it. Fields are never reordered so that newer fields can be appended to the end, which entries
+// written before they existed decode as zero values.
+func encodeKeyPair(keyPair KeyPair) []byte {
+	// Store checksum as raw bytes when possible
+	checksum, err := hex.DecodeString(keyPair.SHA256)
+	if err != nil {
+		checksum = []byte(keyPair.SHA256)
+	}
+
+	data := make([]byte, 0, 64+len(checksum)+len(keyPair.URL)+len(keyPair.ContentType)+len(keyPair.Tier))
+	data = append(data, keyPairEncodingBinary)
+	data = binary.AppendVarint(data, keyPair.Timestamp)
+	data = binary.AppendVarint(data, int64(keyPair.Size))
+	data = appendBytes(data, checksum)
+	data = binary.AppendUvarint(data, uint64(keyPair.Version))
+	data = appendBytes(data, []byte(keyPair.URL))
+	data = appendBytes(data, []byte(keyPair.ContentType))
+	data = binary.AppendVarint(data, keyPair.LastModified)
+	data = binary.AppendVarint(data, keyPair.HitCount)
+	data = binary.LittleEndian.AppendUint64(data, math.Float64bits(keyPair.Hits))
+	data = binary.LittleEndian.AppendUint64(data, math.Float64bits(keyPair.Score))
+	data = binary.AppendVarint(data, int64(keyPair.Queue))
+	data = appendBytes(data, []byte(keyPair.Tier))
+	return data
+}
+
+// appendBytes appends a length-prefixed byte string
+func appendBytes(data []byte, value []byte) []byte {
+	data = binary.AppendUvarint(data, uint64(len(value)))
+	return append(data, value...)
+}
+
+// decodeKeyPair decodes an entry stored under a key in either the binary encoding or JSON
+func decodeKeyPair(key []byte, data []byte) (KeyPair, error) {
+	var keyPair KeyPair
+
+	// Fall back to JSON for entries that were not converted yet
+	if len(data) > 0 && data[0] == '{' {
+		err := json.Unmarshal(data, &keyPair)
+		return keyPair, err
+	}
+	if len(data) == 0 || data[0] != keyPairEncodingBinary {
+		return keyPair, fmt.Errorf("unknown encoding of entry %s", key)
+	}
+
+	// Decode fields in order
+	d := keyPairDecoder{data: data[1:]}
+	keyPair.Key = string(key)
+	keyPair.Timestamp = d.varint()
+	keyPair.Size = int(d.varint())
+	if checksum := d.bytes(); len(checksum) == 32 {
+		keyPair.SHA256 = hex.EncodeToString(checksum)
+	} else {
+		keyPair.SHA256 = string(checksum)
+	}
+	keyPair.Version = int(d.uvarint())
+	keyPair.URL = string(d.bytes())
+	keyPair.ContentType = string(d.bytes())
+	keyPair.LastModified = d.varint()
+	keyPair.HitCount = d.varint()
+	keyPair.Hits = math.Float64frombits(d.uint64())
+	keyPair.Score = math.Float64frombits(d.uint64())
+	keyPair.Queue = int(d.varint())
+	keyPair.Tier = string(d.bytes())
+	if d.err != nil {
+		return keyPair, fmt.Errorf("invalid entry %s: %v", key, d.err)
+	}
+	return keyPair, nil
+}
+
+// keyPairDecoder reads binary encoded fields, remembering the first error. Fields past the end of the
+// data were added after the entry was written and read as zero values.
+type keyPairDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *keyPairDecoder) varint() int64 {
+	if len(d.data) == 0 {
+		return 0
+	}
+	value, n := binary.Varint(d.data)
+	return d.advance(n, value)
+}
+
+func (d *keyPairDecoder) uvarint() uint64 {
+	if len(d.data) == 0 {
+		return 0
+	}
+	value, n := binary.Uvarint(d.data)
+	return uint64(d.advance(n, int64(value)))
+}
+
+func (d *keyPairDecoder) uint64() uint64 {
+	if len(d.data) == 0 {
+		return 0
+	}
+	if len(d.data) < 8 {
+		d.advance(0, 0)
+		return 0
+	}
+	value := binary.LittleEndian.Uint64(d.data)
+	d.data = d.data[8:]
+	return value
+}
+
+func (d *keyPairDecoder) bytes() []byte {
+	if len(d.data) == 0 {
+		return nil
+	}
+	length := d.uvarint()
+	if uint64(len(d.data)) < length {
+		d.advance(0, 0)
+		return nil
+	}
+	value := d.data[:length]
+	d.data = d.data[length:]
+	return value
+}
+
+// advance skips past a decoded value, failing if it could not be decoded
+func (d *keyPairDecoder) advance(n int, value int64) int64 {
+	if n <= 0 {
+		if d.err == nil {
+			d.err = fmt.Errorf("truncated entry")
+		}
+		d.data = nil
+		return 0
+	}
+	d.data = d.data[n:]
+	return value
+}
+
+// migrateEncoding converts entries still stored as JSON to the binary encoding a batch at a time, so
+// that the cache can be used while it runs
+func (c *Cache) migrateEncoding() {
+	// Skip if done before
+	done := false
+	if err := c.database.View(func(tx *bolt.Tx) error {
+		done = string(tx.Bucket([]byte("META")).Get([]byte("encoding"))) == "binary"
+		return nil
+	}); err != nil || done {
+		return
+	}
+
+	var after []byte
+	converted := 0
+	for {
+		// Find next batch of JSON entries
+		var keys [][]byte
+		scanned := 0
+		if err := c.database.View(func(tx *bolt.Tx) error {
+			cur := tx.Bucket([]byte("KEYS")).Cursor()
+
+			// Continue after last entry of previous batch
+			key, keyPairBytes := cur.First()
+			if after != nil {
+				if key, keyPairBytes = cur.Seek(after); bytes.Equal(key, after) {
+					key, keyPairBytes = cur.Next()
+				}
+			}
+
+			for ; key != nil && scanned < encodingBatchSize; key, keyPairBytes = cur.Next() {
+				after = append(after[:0], key...)
+				scanned++
+				if len(keyPairBytes) > 0 && keyPairBytes[0] == '{' {
+					keys = append(keys, append([]byte(nil), key...))
+				}
+			}
+			return nil
+		}); err != nil {
+			log.Errorf("Failed to convert cache entries: %v", err)
+			return
+		}
+		if scanned == 0 {
+			break
+		}
+
+		// Convert batch, rereading entries in case they changed since
+		if err := c.database.Update(func(tx *bolt.Tx) error {
+			b := writeBucket(tx, "KEYS")
+			for _, key := range keys {
+				keyPairBytes := b.Get(key)
+				if len(keyPairBytes) == 0 || keyPairBytes[0] != '{' {
+					continue
+				}
+				keyPair, err := decodeKeyPair(key, keyPairBytes)
+				if err != nil {
+					return err
+				}
+				if err := b.Put(key, encodeKeyPair(keyPair)); err != nil {
+					return err
+				}
+				converted++
+			}
+			return nil
+		}); err != nil {
+			log.Errorf("Failed to convert cache entries: %v", err)
+			return
+		}
+	}
+
+	// Remember that every entry was converted
+	if err := c.database.Update(func(tx *bolt.Tx) error {
+		return writeBucket(tx, "META").Put([]byte("encoding"), []byte("binary"))
+	}); err != nil {
+		log.Errorf("Failed to convert cache entries: %v", err)
+		return
+	}
+	if converted > 0 {
+		log.Infof("Converted %d cache entries to binary encoding", converted)
+	}
+}
@@ -0,0 +1,128 @@
+package mdathome
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// testKeyPair returns an entry with every field set
+func testKeyPair() KeyPair {
+	return KeyPair{
+		Key:          "0123456789abcdef0123456789abcdef",
+		Timestamp:    1700000000,
+		Size:         123456,
+		SHA256:       "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+		Version:      keyPairVersion,
+		URL:          "/data/8172a46adc798f4f4ace6663322a383e/x1-b765e3d5b5ee5d5e4d5d6e5c5d4e4e4d.png",
+		ContentType:  "image/png",
+		LastModified: 1690000000,
+		HitCount:     42,
+		Hits:         3.5,
+		Score:        12.25,
+		Queue:        1,
+		Tier:         CacheTierFast,
+	}
+}
+
+func TestKeyPairEncodingRoundTrip(t *testing.T) {
+	keyPair := testKeyPair()
+	decoded, err := decodeKeyPair([]byte(keyPair.Key), encodeKeyPair(keyPair))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, keyPair) {
+		t.Fatalf("got %+v, expected %+v", decoded, keyPair)
+	}
+}
+
+func TestKeyPairEncodingMissingTrailingFields(t *testing.T) {
+	keyPair := testKeyPair()
+	data := encodeKeyPair(keyPair)
+
+	// Entries written before Hits, Score, Queue and Tier existed end before them
+	decoded, err := decodeKeyPair([]byte(keyPair.Key), data[:len(data)-22])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := keyPair
+	expected.Hits, expected.Score, expected.Queue, expected.Tier = 0, 0, 0, ""
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Fatalf("got %+v, expected %+v", decoded, expected)
+	}
+
+	// Fields cut off part way are still an error
+	if _, err := decodeKeyPair([]byte(keyPair.Key), data[:len(data)-2]); err == nil {
+		t.Fatal("expected error decoding truncated field")
+	}
+}
+
+func TestKeyPairEncodingFallsBackToJSON(t *testing.T) {
+	keyPair := testKeyPair()
+	data, err := json.Marshal(keyPair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeKeyPair([]byte(keyPair.Key), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, keyPair) {
+		t.Fatalf("got %+v, expected %+v", decoded, keyPair)
+	}
+}
+
+// BenchmarkScanKeyPairs compares scanning a bucket of entries stored as JSON against the binary encoding
+func BenchmarkScanKeyPairs(b *testing.B) {
+	const entries = 10000
+	for _, encoding := range []string{"json", "binary"} {
+		b.Run(encoding, func(b *testing.B) {
+			// Fill database with entries in the encoding
+			db, err := bolt.Open(b.TempDir()+"/cache.db", 0600, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			if err := db.Update(func(tx *bolt.Tx) error {
+				bucket, err := tx.CreateBucket([]byte("KEYS"))
+				if err != nil {
+					return err
+				}
+				for i := 0; i < entries; i++ {
+					keyPair := testKeyPair()
+					keyPair.Key = fmt.Sprintf("%032x", i)
+					data := encodeKeyPair(keyPair)
+					if encoding == "json" {
+						if data, err = json.Marshal(keyPair); err != nil {
+							return err
+						}
+					}
+					if err := bucket.Put([]byte(keyPair.Key), data); err != nil {
+						return err
+					}
+				}
+				return nil
+			}); err != nil {
+				b.Fatal(err)
+			}
+
+			// Scan and decode every entry
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := db.View(func(tx *bolt.Tx) error {
+					return tx.Bucket([]byte("KEYS")).ForEach(func(key []byte, data []byte) error {
+						_, err := decodeKeyPair(key, data)
+						return err
+					})
+				}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*entries), "ns/entry")
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package mdathome
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"math/rand"
+	"net/http"
+
+	"github.com/spf13/viper"
+)
+
+// integrityHoldback is how many bytes at the end of an image are withheld until its checksum is verified
+const integrityHoldback = 4096
+
+var errIntegrityMismatch = errors.New("image checksum mismatch")
+
+// errImageTruncated is returned when an image in storage ends before the size recorded for it
+var errImageTruncated = errors.New("image truncated")
+
+// sampleIntegrityCheck decides whether this request should have its image verified
+func sampleIntegrityCheck() bool {
+	percent := viper.GetFloat64("security.verify_image_integrity_sample_percent")
+	return percent >= 100 || rand.Float64()*100 < percent
+}
+
+// integrityWriter hashes a full image as it is written through, withholding the final bytes until the
+// hash has been checked so that a corrupted image is never delivered whole
+type integrityWriter struct {
+	http.ResponseWriter
+	expected string
+	hasher   hash.Hash
+	size     int64
+	written  int64
+	tail     []byte
+}
+
+func newIntegrityWriter(w http.ResponseWriter, expected string, size int64) *integrityWriter {
+	return &integrityWriter{
+		ResponseWriter: w,
+		expected:       expected,
+		hasher:         sha256.New(),
+		size:           size,
+	}
+}
+
+// Checksum returns the hexadecimal SHA-256 of what has been written so far
+func (iw *integrityWriter) Checksum() string {
+	return hex.EncodeToString(iw.hasher.Sum(nil))
+}
+
+func (iw *integrityWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	iw.hasher.Write(p)
+
+	// Pass through everything before the withheld tail
+	if holdFrom := iw.size - integrityHoldback; iw.written < holdFrom {
+		pass := int64(len(p))
+		if pass > holdFrom-iw.written {
+			pass = holdFrom - iw.written
+		}
+		written, err := iw.ResponseWriter.Write(p[:pass])
+		iw.written += int64(written)
+		if err != nil {
+			return written, err
+		}
+		p = p[pass:]
+	}
+
+	// Withhold tail until the whole image has been hashed
+	iw.tail = append(iw.tail, p...)
+	iw.written += int64(len(p))
+	if iw.written < iw.size {
+		return n, nil
+	}
+	if iw.Checksum() != iw.expected {
+		return n - len(p), errIntegrityMismatch
+	}
+	if _, err := iw.ResponseWriter.Write(iw.tail); err != nil {
+		return n - len(p), err
+	}
+	return n, nil
+}
@@ -0,0 +1,104 @@
+package mdathome
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+func TestIntegrityWriter(t *testing.T) {
+	image := bytes.Repeat([]byte("0123456789"), 1000)
+	checksum := sha256.Sum256(image)
+	for _, test := range []struct {
+		name     string
+		image    []byte
+		expected string
+		written  int
+		err      error
+	}{
+		{"intact", image, hex.EncodeToString(checksum[:]), len(image), nil},
+		{"corrupted", append([]byte("x"), image[1:]...), hex.EncodeToString(checksum[:]), len(image) - integrityHoldback, errIntegrityMismatch},
+		{"small", image[:10], hex.EncodeToString(checksum[:]), 0, errIntegrityMismatch},
+	} {
+		// Write image in uneven chunks, withholding the tail of corrupted images
+		w := httptest.NewRecorder()
+		iw := newIntegrityWriter(w, test.expected, int64(len(test.image)))
+		var err error
+		for p := test.image; len(p) > 0 && err == nil; {
+			n := min(len(p), 3000)
+			_, err = iw.Write(p[:n])
+			p = p[n:]
+		}
+		if err != test.err || w.Body.Len() != test.written {
+			t.Errorf("%s: expected %d bytes and %v, got %d bytes and %v", test.name, test.written, test.err, w.Body.Len(), err)
+		}
+	}
+}
+
+func TestCorruptedHitsPurged(t *testing.T) {
+	c := newTestCache(t, 1<<30)
+	previousCache := cache
+	cache = c
+	viper.Set("security.verify_image_integrity", true)
+	viper.Set("security.reject_invalid_tokens", false)
+	t.Cleanup(func() {
+		cache = previousCache
+		viper.Set("security.verify_image_integrity", nil)
+		viper.Set("security.reject_invalid_tokens", nil)
+	})
+
+	image := bytes.Repeat([]byte("0123456789"), 1000)
+	checksum := sha256.Sum256(image)
+	filename := "x1-" + hex.EncodeToString(checksum[:]) + ".png"
+	requestURI := "/data/0123456789abcdef0123456789abcdef/" + filename
+	for _, test := range []struct {
+		name    string
+		corrupt func(path string) error
+	}{
+		{"corrupted", func(path string) error {
+			return os.WriteFile(path, append([]byte("x"), image[1:]...), 0644)
+		}},
+		{"truncated", func(path string) error {
+			return os.Truncate(path, int64(len(image)-100))
+		}},
+	} {
+		if err := c.Set(requestURI, time.Now(), image); err != nil {
+			t.Fatalf("%s: failed to cache image: %v", test.name, err)
+		}
+		if err := test.corrupt(getTestImagePath(t, c, requestURI)); err != nil {
+			t.Fatalf("%s: failed to damage image: %v", test.name, err)
+		}
+
+		// Response is aborted before the image is delivered whole
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/token"+requestURI, nil)
+		r = mux.SetURLVars(r, map[string]string{"token": "token", "image_type": "data", "chapter_hash": "0123456789abcdef0123456789abcdef", "image_filename": filename})
+		func() {
+			defer func() {
+				if recovered := recover(); recovered != http.ErrAbortHandler {
+					t.Fatalf("%s: expected response to be aborted, got %v", test.name, recovered)
+				}
+			}()
+			requestHandler(w, r)
+		}()
+		if w.Body.Len() >= len(image) {
+			t.Fatalf("%s: expected image to be cut short, got %d bytes", test.name, w.Body.Len())
+		}
+
+		// Image is purged so that it is fetched again
+		if _, err := c.getEntry(hashRequestURI(requestURI)); err == nil {
+			t.Fatalf("%s: expected entry to be purged", test.name)
+		}
+		if _, err := os.Stat(getTestImagePath(t, c, requestURI)); !os.IsNotExist(err) {
+			t.Fatalf("%s: expected image to be removed, got %v", test.name, err)
+		}
+	}
+}
@@ -3,8 +3,11 @@ package mdathome
 import (
 	"bytes"
 	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"regexp"
@@ -68,6 +71,9 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 		clientDownloadedBytesTotal = metrics.GetOrCreateCounter(fmt.Sprintf("client_downloaded_bytes_total%s", labels))
 		clientServedBytesTotal     = metrics.GetOrCreateCounter(fmt.Sprintf("client_served_bytes_total%s", labels))
 
+		clientCoalescedTotal      = metrics.GetOrCreateCounter(fmt.Sprintf("client_coalesced_total%s", labels))
+		clientCoalescedBytesTotal = metrics.GetOrCreateCounter(fmt.Sprintf("client_coalesced_bytes_total%s", labels))
+
 		clientCorruptedTotal = metrics.GetOrCreateCounter(fmt.Sprintf("client_corrupted_total%s", labels))
 		clientDroppedTotal   = metrics.GetOrCreateCounter(fmt.Sprintf("client_dropped_total%s", labels))
 		clientFailedTotal    = metrics.GetOrCreateCounter(fmt.Sprintf("client_failed_total%s", labels))
@@ -76,6 +82,13 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 		clientRequestProcessSeconds  = metrics.GetOrCreateHistogram(fmt.Sprintf("client_request_process_seconds%s", labels))
 	)
 
+	// Check if client is allowed to serve requests at all
+	if checkClientState(w) {
+		requestLogger.WithFields(logrus.Fields{"event": "dropped", "reason": "client unavailable"}).Debugf("Request from %s dropped due to client being paused or compromised", remoteAddr)
+		clientDroppedTotal.Inc()
+		return
+	}
+
 	// Check if hostname is rejected
 	requestHostname := strings.Split(r.Host, ":")[0]
 	if viper.GetBool("security.reject_invalid_hostname") && requestHostname != clientHostname {
@@ -139,6 +152,9 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 		r.Header.Set("Referer", matched)
 	}
 
+	// Throttle response body to configured egress speed
+	w = egressLimiter.Wrap(r.Context(), w)
+
 	// Add server headers
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Expose-Headers", "*")
@@ -156,17 +172,13 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 	requestLogger.WithFields(logrus.Fields{"event": "received"}).Infof("Request from %s received", remoteAddr)
 	clientRequestsTotal.Inc()
 
-	// Check if browser token exists
-	if r.Header.Get("If-Modified-Since") != "" {
-		// Log browser cache
-		requestLogger.WithFields(logrus.Fields{"event": "cached"}).Debugf("Request from %s cached by browser", remoteAddr)
-		clientSkippedTotal.Inc()
-		w.WriteHeader(http.StatusNotModified)
-		return
-	}
+	// Load image from cache, counting request towards admission
+	cache.recordRequest(sanitizedURL)
+	imageFile, imageEntry, err := cache.Get(sanitizedURL)
+	imageSize, imageModTime := int64(imageEntry.Size), time.Unix(imageEntry.LastModified, 0)
 
-	// Load image from cache
-	imageFile, imageSize, imageModTime, err := cache.Get(sanitizedURL)
+	// Decide whether to verify image integrity for this request
+	verifyIntegrity := viper.GetBool("security.verify_image_integrity") && tokens["image_type"] == "data" && sampleIntegrityCheck()
 
 	// Check image integrity if found in cache
 	var imageBuffer bytes.Buffer
@@ -175,8 +187,8 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 		// Close image file at the end of goroutine
 		defer imageFile.Close()
 
-		// Check if client is running in low-memory mode
-		if !viper.GetBool("performance.low_memory_mode") {
+		// Check if client is running in low-memory mode, and skip body I/O for HEAD requests
+		if !viper.GetBool("performance.low_memory_mode") && r.Method != http.MethodHead {
 			// Load image from disk to buffer if not low-memory mode
 			imageBuffer.Grow(int(imageSize))
 			if _, err := io.Copy(&imageBuffer, imageFile); err != nil {
@@ -184,7 +196,7 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 			}
 
 			// Check if verifying image integrity
-			if viper.GetBool("security.verify_image_integrity") && tokens["image_type"] == "data" {
+			if verifyIntegrity {
 				// Check and get hash from image filename
 				subTokens := strings.Split(tokens["image_filename"], "-")
 				if len(subTokens) == 2 {
@@ -219,47 +231,99 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 		imageOk = false
 	}
 
+	// Prepare validators, only trusting cached ones if the cached image is being served
+	imageETag := getImageETag(tokens["image_type"], tokens["image_filename"], "")
+	validatorModTime := time.Time{}
+	if imageOk {
+		imageETag = getImageETag(tokens["image_type"], tokens["image_filename"], imageEntry.SHA256)
+		validatorModTime = imageModTime
+	}
+	if imageETag != "" {
+		w.Header().Set("ETag", imageETag)
+	}
+
+	// Check if browser already holds the same image
+	if checkNotModified(r, imageETag, validatorModTime) {
+		// Log browser cache
+		requestLogger.WithFields(logrus.Fields{"event": "cached"}).Debugf("Request from %s cached by browser", remoteAddr)
+		clientSkippedTotal.Inc()
+		if !validatorModTime.IsZero() {
+			w.Header().Set("Last-Modified", validatorModTime.UTC().Format(http.TimeFormat))
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	// Check if image exists and is a proper image and if cache-control is set
 	imageLength := 0
 	if !imageOk {
 		// Log cache miss
 		requestLogger.WithFields(logrus.Fields{"event": "miss"}).Debugf("Request from %s missed cache", remoteAddr)
 		clientMissedTotal.Inc()
+		recordPolicyMiss(cache.policy)
 		w.Header().Set("X-Cache", "MISS")
 
-		// Send request
-		imageFromUpstream, err := client.Get(serverResponse.ImageServer + sanitizedURL)
-		if err != nil {
-			requestLogger.WithFields(logrus.Fields{"event": "failed", "upstream": serverResponse.ImageServer + sanitizedURL, "error": err}).Warnf("Request from %s failed upstream: %v", remoteAddr, err)
+		// Answer probes without fetching from upstream, as there is nothing to describe yet
+		if r.Method == http.MethodHead {
+			w.Header().Del("ETag")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// Serve only from cache if paused
+		if clientPaused.Load() {
+			requestLogger.WithFields(logrus.Fields{"event": "dropped", "reason": "client paused"}).Debugf("Request from %s dropped due to client being paused", remoteAddr)
+			clientDroppedTotal.Inc()
+			writeRetryAfter(w, viper.GetInt("client.paused_retry_after_seconds"))
+			return
+		}
+
+		// Join in-flight upstream fetch for image, or start one
+		fetch, joined := upstreamFetches.Join(sanitizedURL)
+		defer fetch.Release()
+		if joined {
+			requestLogger.WithFields(logrus.Fields{"event": "coalesced"}).Debugf("Request from %s joined in-flight upstream fetch", remoteAddr)
+			clientCoalescedTotal.Inc()
+		}
+
+		// Wait for upstream response
+		if err := fetch.Wait(); err != nil {
+			requestLogger.WithFields(logrus.Fields{"event": "failed", "upstream": fetch.upstream, "error": err}).Warnf("Request from %s failed upstream: %v", remoteAddr, err)
 			clientFailedTotal.Inc()
+
+			// Tell readers when to come back if upstream is being avoided
+			var circuitErr *circuitOpenError
+			if errors.As(err, &circuitErr) {
+				writeRetryAfter(w, int(math.Ceil(circuitErr.retryAfter.Seconds())))
+				return
+			}
+
+			// Tell readers that upstream sent something other than the image
+			var payloadErr *payloadError
+			if errors.As(err, &payloadErr) {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
 			w.WriteHeader(http.StatusServiceUnavailable)
 			return
 		}
-		defer imageFromUpstream.Body.Close()
 
 		// If not 200
-		if imageFromUpstream.StatusCode != 200 {
-			requestLogger.WithFields(logrus.Fields{"event": "failed", "error": "received non-200 status code", "status": imageFromUpstream.StatusCode}).Warnf("Request from %s failed upstream: %d", remoteAddr, imageFromUpstream.StatusCode)
+		if fetch.status != 200 {
+			requestLogger.WithFields(logrus.Fields{"event": "failed", "error": "received non-200 status code", "status": fetch.status}).Warnf("Request from %s failed upstream: %d", remoteAddr, fetch.status)
 			clientFailedTotal.Inc()
-			w.WriteHeader(imageFromUpstream.StatusCode)
+			w.WriteHeader(fetch.status)
 			return
 		}
 
 		// Set Content-Length if exists
-		if contentLength := imageFromUpstream.Header.Get("Content-Length"); contentLength != "" {
+		if contentLength := fetch.header.Get("Content-Length"); contentLength != "" {
 			w.Header().Set("Content-Length", contentLength)
 		}
 
 		// Set Last-Modified
-		modTime := time.Now()
-		if lastModified := imageFromUpstream.Header.Get("Last-Modified"); lastModified != "" {
+		if lastModified := fetch.header.Get("Last-Modified"); lastModified != "" {
 			w.Header().Set("Last-Modified", lastModified)
-
-			if upstreamModTime, err := time.Parse(http.TimeFormat, lastModified); err == nil {
-				modTime = upstreamModTime
-			} else if seconds, err := strconv.Atoi(lastModified); err == nil && seconds > 0 {
-				modTime = time.Unix(int64(seconds), 0)
-			}
 		}
 
 		// Set timing header
@@ -268,40 +332,44 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 		clientRequestProcessSeconds.Update(float64(processedTime) / 1000.0)
 		w.Header().Set("X-Time-Taken", strconv.Itoa(int(processedTime)))
 
-		// Copy request to response body
-		var imageBuffer bytes.Buffer
-		_, err = io.Copy(w, io.TeeReader(imageFromUpstream.Body, &imageBuffer))
+		// Copy shared upstream body to response body
+		written, err := io.Copy(w, fetch.NewReader())
+		imageLength = int(written)
 
 		// Check if image was streamed properly
 		if err != nil {
-			requestLogger.WithFields(logrus.Fields{"event": "failed", "upstream": serverResponse.ImageServer + sanitizedURL, "error": err}).Warnf("Request from %s failed downstream: %v", remoteAddr, err)
+			requestLogger.WithFields(logrus.Fields{"event": "failed", "upstream": fetch.upstream, "error": err}).Warnf("Request from %s failed downstream: %v", remoteAddr, err)
 			clientFailedTotal.Inc()
 			return
 		}
 
-		// Save hash
-		err = cache.Set(sanitizedURL, modTime, imageBuffer.Bytes())
-		if err != nil {
-			requestLogger.WithFields(logrus.Fields{"event": "failed", "error": err}).Warnf("Request from %s failed to save: %v", remoteAddr, err)
-			clientFailedTotal.Inc()
+		// Update bytes downloaded, or bytes saved if another request downloaded it or it was transcoded locally
+		if joined {
+			clientCoalescedBytesTotal.Add(imageLength)
+		} else if !fetch.transcoded {
+			clientDownloadedBytesTotal.Add(imageLength)
 		}
-
-		// Update bytes downloaded
-		imageLength = len(imageBuffer.Bytes())
-		clientDownloadedBytesTotal.Add(imageLength)
-		requestLogger.WithFields(logrus.Fields{"event": "committed", "image_length": imageLength}).Debugf("Request from %s committed with size %d bytes", remoteAddr, imageLength)
 	} else {
-		// Get length
-		imageLength = int(imageSize)
-
 		// Log cache hit
 		requestLogger.WithFields(logrus.Fields{"event": "hit"}).Debugf("Request from %s hit cache", remoteAddr)
 		clientHitsTotal.Inc()
+		recordPolicyHit(cache.policy)
 		w.Header().Set("X-Cache", "HIT")
 
-		// Set Content-Length & Last-Modified
-		w.Header().Set("Content-Length", strconv.Itoa(imageLength))
-		w.Header().Set("Last-Modified", imageModTime.Format(http.TimeFormat))
+		// Set Last-Modified & advertise range support
+		w.Header().Set("Last-Modified", imageModTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("Accept-Ranges", "bytes")
+
+		// Parse requested byte ranges if preconditions allow
+		var ranges []byteRange
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && checkIfRange(r, imageETag, imageModTime) {
+			if ranges, err = parseRange(rangeHeader, imageSize); err != nil {
+				requestLogger.WithFields(logrus.Fields{"event": "dropped", "reason": "range not satisfiable", "range": rangeHeader}).Debugf("Request from %s asked for unsatisfiable range %s", remoteAddr, rangeHeader)
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", imageSize))
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+		}
 
 		// Set timing header
 		processedTime := time.Since(startTime).Milliseconds()
@@ -309,13 +377,44 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 		clientRequestProcessSeconds.Update(float64(processedTime) / 1000.0)
 		w.Header().Set("X-Time-Taken", strconv.Itoa(int(processedTime)))
 
-		// Stream image to client
-		var err error
-		if imageBuffer.Len() == 0 {
-			_, err = io.Copy(w, imageFile)
-		} else {
-			imageReader := bytes.NewReader(imageBuffer.Bytes())
-			_, err = io.Copy(w, imageReader)
+		// Stream image, or requested ranges of it, to client
+		var imageReader io.ReaderAt = imageFile
+		if imageBuffer.Len() != 0 {
+			imageReader = bytes.NewReader(imageBuffer.Bytes())
+		}
+
+		// Verify image integrity while streaming full images that were not verified in memory
+		var imageWriter http.ResponseWriter = w
+		var integrityWriter *integrityWriter
+		if filenameHash := getFilenameHash(tokens["image_filename"]); verifyIntegrity && filenameHash != "" && imageBuffer.Len() == 0 && len(ranges) == 0 && r.Method == http.MethodGet {
+			integrityWriter = newIntegrityWriter(w, filenameHash, imageSize)
+			imageWriter = integrityWriter
+		}
+		contentType := imageEntry.ContentType
+		if contentType == "" {
+			contentType = getImageContentType(tokens["image_filename"])
+		}
+		written, err := serveImageRanges(imageWriter, r, imageReader, imageSize, ranges, contentType)
+		imageLength = int(written)
+
+		// Abort connection and purge image if it turned out to be corrupted
+		if errors.Is(err, errIntegrityMismatch) {
+			requestLogger.WithFields(logrus.Fields{"event": "checksum", "given": integrityWriter.expected, "calculated": integrityWriter.Checksum()}).Warnf("Request from %s generated invalid checksum %s != %s", remoteAddr, integrityWriter.Checksum(), integrityWriter.expected)
+			clientCorruptedTotal.Inc()
+			if err := cache.Purge(sanitizedURL); err != nil {
+				requestLogger.WithFields(logrus.Fields{"event": "failed", "error": err}).Warnf("Request from %s failed to purge corrupted image: %v", remoteAddr, err)
+			}
+			panic(http.ErrAbortHandler)
+		}
+
+		// Abort connection and purge image if it is shorter than recorded
+		if errors.Is(err, errImageTruncated) {
+			requestLogger.WithFields(logrus.Fields{"event": "truncated", "size": imageSize, "written": written}).Warnf("Request from %s found image truncated after %d of %d bytes", remoteAddr, written, imageSize)
+			clientCorruptedTotal.Inc()
+			if err := cache.Purge(sanitizedURL); err != nil {
+				requestLogger.WithFields(logrus.Fields{"event": "failed", "error": err}).Warnf("Request from %s failed to purge truncated image: %v", remoteAddr, err)
+			}
+			panic(http.ErrAbortHandler)
 		}
 
 		// Check if image was streamed properly
@@ -336,11 +435,34 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 	clientServedBytesTotal.Add(imageLength)
 }
 
+// adminCompactHandler starts compacting the database while serving, if the configured admin token is given
+func adminCompactHandler(w http.ResponseWriter, r *http.Request) {
+	// Hide endpoint unless enabled
+	token := viper.GetString("security.admin_token")
+	if token == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Check token
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// Start compaction
+	if err := cache.StartCompaction(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
 // ShrinkDatabase initialises and shrinks the MD@Home database
 func ShrinkDatabase() {
-	// Prepare diskcache
+	// Prepare diskcache without starting any cache threads
 	log.Info("Preparing database...")
-	cache = OpenCache(viper.GetString(KeyCacheDirectory), 0)
+	cache = newCache(0)
 	defer cache.Close()
 
 	// Attempts to start cache shrinking
@@ -368,6 +490,9 @@ func StartServer() {
 	)
 	defer cache.Close()
 
+	// Enforce egress speed limit
+	egressLimiter.SetRate(viper.GetInt(KeyMaxSpeed) * 1000 / 8)
+
 	// Prepare MaxMind geolocation database
 	if viper.GetString("metrics.maxmind_license_key") != "" {
 		log.Warnf("Loading geolocation data in the background...")
@@ -382,6 +507,7 @@ func StartServer() {
 	transport.MaxConnsPerHost = 0
 	transport.IdleConnTimeout = 60 * time.Second
 	transport.DisableKeepAlives = !viper.GetBool("performance.upstream_connection_reuse")
+	transport.ResponseHeaderTimeout = time.Duration(viper.GetInt("upstream.first_byte_timeout_seconds")) * time.Second
 
 	// Prepare upstream client
 	client = &http.Client{
@@ -394,10 +520,26 @@ func StartServer() {
 
 	// Prepare TLS reloader
 	certHandler = NewCertificateReloader(controlGetCertificate())
+
+	// Act on paused flag of first control ping before serving
+	updateClientState(&serverResponse)
+
+	// Prepare upstream pool from the image server given by the first control ping
+	imageServer := serverResponse.ImageServer
+	if viper.GetString("override.upstream") != "" {
+		imageServer = viper.GetString("override.upstream")
+	}
+	upstreams.Update(imageServer)
+	go upstreams.startHealthChecks()
 	go func() {
 		for {
 			time.Sleep(24 * time.Hour)
 
+			// Never reload certificates once compromised
+			if clientCompromised.Load() {
+				continue
+			}
+
 			// Update certificate
 			log.Infof("Reloading certificates...")
 			if err := certHandler.updateCertificate(controlGetCertificate()); err != nil {
@@ -430,6 +572,9 @@ func StartServer() {
 		}
 	})
 
+	// Handle admin requests
+	r.HandleFunc("/admin/compact", adminCompactHandler).Methods(http.MethodPost)
+
 	// If configured behind reverse proxies
 	if viper.GetBool("metrics.use_forwarded_for_headers") {
 		r.Use(handlers.ProxyHeaders)
@@ -0,0 +1,177 @@
+package mdathome
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/spf13/viper"
+)
+
+// memoryTierGhostEntries is how many recently seen but unadmitted keys are remembered
+const memoryTierGhostEntries = 16384
+
+// memoryTierMaxImageFraction keeps a single image from taking more than this fraction of the memory tier
+const memoryTierMaxImageFraction = 8
+
+var (
+	clientMemoryCacheHitsTotal    = metrics.NewCounter("client_memory_cache_hits_total")
+	clientMemoryCacheMissesTotal  = metrics.NewCounter("client_memory_cache_misses_total")
+	clientMemoryCacheAdmitted     = metrics.NewCounter("client_memory_cache_admitted_total")
+	clientMemoryCacheEvictedBytes = metrics.NewCounter("client_memory_cache_evicted_bytes")
+	clientMemoryCacheSize         = metrics.NewCounter("client_memory_cache_size_bytes")
+)
+
+// memoryTierEntry is an image held in memory along with everything needed to serve it
+type memoryTierEntry struct {
+	keyPair KeyPair
+	data    []byte
+}
+
+// memoryTier holds the hottest images in memory in front of storage. Images are only admitted
+// once they have been seen twice recently, and the least recently used are evicted first.
+type memoryTier struct {
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List
+
+	// Keys seen once, in order of first sighting
+	ghosts     map[string]struct{}
+	ghostOrder []string
+	ghostNext  int
+}
+
+func newMemoryTier() *memoryTier {
+	return &memoryTier{
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		ghosts:     make(map[string]struct{}),
+		ghostOrder: make([]string, memoryTierGhostEntries),
+	}
+}
+
+// getLimit returns the configured byte budget of the memory tier
+func (t *memoryTier) getLimit() int64 {
+	return int64(viper.GetInt("cache.memory_size_mebibytes")) * 1024 * 1024
+}
+
+// Get returns an image held in memory, marking it as recently used
+func (t *memoryTier) Get(hash string) (*memoryTierEntry, bool) {
+	if t.getLimit() <= 0 {
+		return nil, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	element, ok := t.entries[hash]
+	if !ok {
+		clientMemoryCacheMissesTotal.Inc()
+		return nil, false
+	}
+	t.lru.MoveToFront(element)
+	clientMemoryCacheHitsTotal.Inc()
+	return element.Value.(*memoryTierEntry), true
+}
+
+// Admit reports whether an image read from storage should be copied into memory, which is the
+// case the second time it is seen recently if it fits
+func (t *memoryTier) Admit(hash string, size int64) bool {
+	limit := t.getLimit()
+	if limit <= 0 || size > limit/memoryTierMaxImageFraction {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Admit if seen before
+	if _, ok := t.ghosts[hash]; ok {
+		delete(t.ghosts, hash)
+		return true
+	}
+
+	// Otherwise remember sighting, forgetting the oldest
+	if oldest := t.ghostOrder[t.ghostNext]; oldest != "" {
+		delete(t.ghosts, oldest)
+	}
+	t.ghostOrder[t.ghostNext] = hash
+	t.ghostNext = (t.ghostNext + 1) % len(t.ghostOrder)
+	t.ghosts[hash] = struct{}{}
+	return false
+}
+
+// Set stores an image in memory, evicting the least recently used images until it fits
+func (t *memoryTier) Set(entry *memoryTierEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Replace existing image
+	hash := entry.keyPair.Key
+	if element, ok := t.entries[hash]; ok {
+		t.remove(element)
+	}
+
+	// Evict till image fits
+	limit := t.getLimit()
+	for t.size+int64(len(entry.data)) > limit && t.lru.Len() > 0 {
+		evicted := t.lru.Back()
+		clientMemoryCacheEvictedBytes.Add(len(evicted.Value.(*memoryTierEntry).data))
+		t.remove(evicted)
+	}
+
+	// Store image
+	t.entries[hash] = t.lru.PushFront(entry)
+	t.size += int64(len(entry.data))
+	clientMemoryCacheSize.Add(len(entry.data))
+	clientMemoryCacheAdmitted.Inc()
+}
+
+// Touch updates the entry kept alongside an image after its timestamp was refreshed. Entries are
+// replaced rather than modified as they may still be in use.
+func (t *memoryTier) Touch(keyPair KeyPair) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if element, ok := t.entries[keyPair.Key]; ok {
+		entry := element.Value.(*memoryTierEntry)
+		element.Value = &memoryTierEntry{keyPair: keyPair, data: entry.data}
+	}
+}
+
+// Delete drops an image from memory, such as when it is purged or evicted from storage
+func (t *memoryTier) Delete(hash string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if element, ok := t.entries[hash]; ok {
+		t.remove(element)
+	}
+}
+
+func (t *memoryTier) remove(element *list.Element) {
+	entry := element.Value.(*memoryTierEntry)
+	t.lru.Remove(element)
+	delete(t.entries, entry.keyPair.Key)
+	t.size -= int64(len(entry.data))
+	clientMemoryCacheSize.Add(-1 * len(entry.data))
+}
+
+// admitObject copies an image read from storage into memory if it is admitted, returning a reader
+// to use in place of the original object
+func (t *memoryTier) admitObject(object StorageObject, keyPair KeyPair) StorageObject {
+	if !t.Admit(keyPair.Key, int64(keyPair.Size)) {
+		return object
+	}
+
+	// Read whole image without moving the object's offset, in case it has to be served as is
+	data := make([]byte, keyPair.Size)
+	if n, err := object.ReadAt(data, 0); n != len(data) {
+		log.Warnf("Failed to read image %s into memory: %v", keyPair.Key, err)
+		return object
+	}
+	object.Close()
+
+	// Store and serve from memory
+	t.Set(&memoryTierEntry{keyPair: keyPair, data: data})
+	return memoryReader{bytes.NewReader(data)}
+}
@@ -0,0 +1,88 @@
+package mdathome
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestMemoryTierAdmitsAndEvicts(t *testing.T) {
+	setDefaultConfiguration()
+	viper.Set("cache.memory_size_mebibytes", 1)
+	t.Cleanup(func() {
+		viper.Set("cache.memory_size_mebibytes", nil)
+	})
+	tier := newMemoryTier()
+	imageSize := int64(100 * 1024)
+
+	// Images are admitted the second time they are seen, if small enough
+	if tier.Admit("a", imageSize) || !tier.Admit("a", imageSize) {
+		t.Fatalf("Expected image to be admitted on second sighting only")
+	}
+	if tier.Admit("huge", 1024*1024) || tier.Admit("huge", 1024*1024) {
+		t.Fatalf("Expected image larger than an eighth of the tier to never be admitted")
+	}
+
+	// Least recently used images are evicted first
+	set := func(hash string) {
+		tier.Set(&memoryTierEntry{keyPair: KeyPair{Key: hash}, data: make([]byte, imageSize)})
+	}
+	for _, hash := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"} {
+		set(hash)
+	}
+	if _, ok := tier.Get("a"); !ok {
+		t.Fatalf("Expected image to be held")
+	}
+	set("k")
+	for hash, held := range map[string]bool{"a": true, "b": false, "c": true, "k": true} {
+		if _, ok := tier.Get(hash); ok != held {
+			t.Fatalf("Expected %s to be held %v, got %v", hash, held, ok)
+		}
+	}
+	if tier.size != 10*imageSize {
+		t.Fatalf("Expected %d bytes held, got %d", 10*imageSize, tier.size)
+	}
+
+	// Deleted images are dropped
+	tier.Delete("a")
+	if _, ok := tier.Get("a"); ok || tier.size != 9*imageSize {
+		t.Fatalf("Expected image to be dropped, %d bytes held", tier.size)
+	}
+}
+
+func TestHotImagesServedFromMemory(t *testing.T) {
+	c := newTestCache(t, 1<<30)
+	viper.Set("cache.memory_size_mebibytes", 1)
+	t.Cleanup(func() {
+		viper.Set("cache.memory_size_mebibytes", nil)
+	})
+	image := bytes.Repeat([]byte("image"), 1000)
+	if err := c.Set("/data/x/0.png", time.Now(), image); err != nil {
+		t.Fatalf("Failed to cache image: %v", err)
+	}
+
+	// Image is copied into memory on its second hit and served from there afterwards
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			if err := os.Remove(getTestImagePath(t, c, "/data/x/0.png")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		object, keyPair, err := c.Get("/data/x/0.png")
+		if err != nil {
+			t.Fatalf("Failed to get image on hit %d: %v", i, err)
+		}
+		data, err := io.ReadAll(object)
+		object.Close()
+		if err != nil || !bytes.Equal(data, image) || keyPair.Size != len(image) {
+			t.Fatalf("Unexpected image of %d bytes on hit %d: %v", len(data), i, err)
+		}
+	}
+	if hits := c.takeHits(hashRequestURI("/data/x/0.png")); hits != 3 {
+		t.Fatalf("Expected hits from memory to be counted, got %d", hits)
+	}
+}
@@ -22,6 +22,8 @@ func prepareConfigurationReload() {
 		// Run manual configuration updates
 		//// Update cache limits
 		cache.UpdateCacheLimit(viper.GetInt(KeyCacheSize) * 1024 * 1024)
+		//// Update egress speed limit
+		egressLimiter.SetRate(viper.GetInt(KeyMaxSpeed) * 1000 / 8)
 	})
 	viper.WatchConfig()
 }
@@ -0,0 +1,338 @@
+package mdathome
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/spf13/viper"
+)
+
+// Eviction policies selectable through `cache.eviction_policy`
+const (
+	EvictionPolicyLRU    = "lru"
+	EvictionPolicyLFU    = "lfu"
+	EvictionPolicyS3FIFO = "s3fifo"
+	EvictionPolicyGDSF   = "gdsf"
+)
+
+// policyHitsPerUpdate is how many hits an entry gathers in memory before its stats are written back
+const policyHitsPerUpdate = 16
+
+// s3fifoGhostEntries is how many keys recently evicted from the small queue are remembered
+const s3fifoGhostEntries = 65536
+
+// evictionPolicy decides in which order entries are evicted. Entries are kept in an index ordered by
+// class and then priority, and the lowest are offered up for eviction first.
+type evictionPolicy interface {
+	// Name returns the `cache.eviction_policy` value of the policy
+	Name() string
+
+	// Insert initialises the stats of a newly cached entry
+	Insert(keyPair *KeyPair)
+
+	// Hit updates the stats of an entry read a number of times since its last update, before its timestamp is refreshed
+	Hit(keyPair *KeyPair, hits int)
+
+	// Order returns the class and priority of an entry in the eviction index
+	Order(keyPair KeyPair) (byte, float64)
+
+	// Start returns the eviction index position to look for victims from, or nil for the start
+	Start(cacheLimit int) []byte
+
+	// Evict reports whether a victim should be evicted, otherwise updating it to be kept
+	Evict(keyPair *KeyPair) bool
+
+	// Reconcile returns a reconciler correcting any policy state from a full scan of entries
+	Reconcile() reconciler
+}
+
+// reconciler corrects state kept about entries from a scan of every entry, fed one at a time
+type reconciler interface {
+	// Add counts an entry of the scan
+	Add(keyPair KeyPair)
+
+	// Finish applies the corrected state once every entry was added
+	Finish()
+}
+
+// nopReconciler is the reconciler of policies that keep no state
+type nopReconciler struct{}
+
+func (nopReconciler) Add(keyPair KeyPair) {}
+func (nopReconciler) Finish()             {}
+
+// newEvictionPolicy returns the eviction policy of the given name
+func newEvictionPolicy(name string) (evictionPolicy, error) {
+	switch name {
+	case EvictionPolicyLRU, "":
+		return &lruPolicy{}, nil
+	case EvictionPolicyLFU:
+		return &lfuPolicy{}, nil
+	case EvictionPolicyS3FIFO:
+		return newS3FIFOPolicy(), nil
+	case EvictionPolicyGDSF:
+		return &gdsfPolicy{}, nil
+	default:
+		return nil, fmt.Errorf("unknown eviction policy '%s'", name)
+	}
+}
+
+// recordPolicyHit counts a cache hit against the eviction policy in use
+func recordPolicyHit(policy evictionPolicy) {
+	metrics.GetOrCreateCounter(fmt.Sprintf(`client_cache_policy_hits_total{policy=%q}`, policy.Name())).Inc()
+}
+
+// recordPolicyMiss counts a cache miss against the eviction policy in use
+func recordPolicyMiss(policy evictionPolicy) {
+	metrics.GetOrCreateCounter(fmt.Sprintf(`client_cache_policy_misses_total{policy=%q}`, policy.Name())).Inc()
+}
+
+// registerPolicyMetrics exposes the hit ratio achieved by an eviction policy
+func registerPolicyMetrics(policy evictionPolicy) {
+	hits := metrics.GetOrCreateCounter(fmt.Sprintf(`client_cache_policy_hits_total{policy=%q}`, policy.Name()))
+	misses := metrics.GetOrCreateCounter(fmt.Sprintf(`client_cache_policy_misses_total{policy=%q}`, policy.Name()))
+	metrics.GetOrCreateGauge(fmt.Sprintf(`client_cache_hit_ratio{policy=%q}`, policy.Name()), func() float64 {
+		total := hits.Get() + misses.Get()
+		if total == 0 {
+			return 0
+		}
+		return float64(hits.Get()) / float64(total)
+	})
+}
+
+// lruPolicy evicts the least recently used entries first
+type lruPolicy struct{}
+
+func (p *lruPolicy) Name() string                { return EvictionPolicyLRU }
+func (p *lruPolicy) Insert(keyPair *KeyPair)     {}
+func (p *lruPolicy) Hit(keyPair *KeyPair, n int) {}
+func (p *lruPolicy) Start(cacheLimit int) []byte { return nil }
+func (p *lruPolicy) Evict(keyPair *KeyPair) bool { return true }
+func (p *lruPolicy) Reconcile() reconciler       { return nopReconciler{} }
+
+func (p *lruPolicy) Order(keyPair KeyPair) (byte, float64) {
+	return 0, float64(keyPair.Timestamp)
+}
+
+// lfuPolicy evicts the least frequently used entries first, with hits losing half their weight every
+// `cache.eviction.lfu_half_life_seconds` so that entries that were once popular eventually go
+type lfuPolicy struct{}
+
+func (p *lfuPolicy) Name() string                { return EvictionPolicyLFU }
+func (p *lfuPolicy) Start(cacheLimit int) []byte { return nil }
+func (p *lfuPolicy) Evict(keyPair *KeyPair) bool { return true }
+func (p *lfuPolicy) Reconcile() reconciler       { return nopReconciler{} }
+
+func (p *lfuPolicy) getHalfLife() float64 {
+	halfLife := viper.GetFloat64("cache.eviction.lfu_half_life_seconds")
+	if halfLife <= 0 {
+		halfLife = 86400
+	}
+	return halfLife
+}
+
+func (p *lfuPolicy) Insert(keyPair *KeyPair) {
+	keyPair.Hits = 1
+	keyPair.Score = p.getPriority(*keyPair)
+}
+
+func (p *lfuPolicy) Hit(keyPair *KeyPair, hits int) {
+	// Decay hits since last update before adding new ones
+	elapsed := float64(time.Now().Unix() - keyPair.Timestamp)
+	keyPair.Hits = keyPair.Hits*math.Exp2(-elapsed/p.getHalfLife()) + float64(hits)
+	keyPair.Score = p.getPriority(*keyPair)
+}
+
+func (p *lfuPolicy) Order(keyPair KeyPair) (byte, float64) {
+	return 0, keyPair.Score
+}
+
+// getPriority compares decayed frequencies at a common point in time, where decaying everything by the
+// same factor leaves the order unchanged, so that priorities never have to be recomputed
+func (p *lfuPolicy) getPriority(keyPair KeyPair) float64 {
+	return math.Log2(math.Max(keyPair.Hits, 1)) + float64(time.Now().Unix())/p.getHalfLife()
+}
+
+// s3fifoPolicy implements S3-FIFO, which keeps new entries in a small FIFO queue and only moves those
+// hit again into the main FIFO queue, remembering recently evicted keys to admit them straight into
+// the main queue if they come back
+type s3fifoPolicy struct {
+	mu        sync.Mutex
+	smallSize int
+
+	// Keys recently evicted from the small queue
+	ghosts     map[string]struct{}
+	ghostOrder []string
+	ghostNext  int
+}
+
+// S3-FIFO queues, which are also their classes in the eviction index
+const (
+	s3fifoSmall = 0
+	s3fifoMain  = 1
+)
+
+func newS3FIFOPolicy() *s3fifoPolicy {
+	return &s3fifoPolicy{
+		ghosts:     make(map[string]struct{}),
+		ghostOrder: make([]string, s3fifoGhostEntries),
+	}
+}
+
+func (p *s3fifoPolicy) Name() string { return EvictionPolicyS3FIFO }
+
+func (p *s3fifoPolicy) Insert(keyPair *KeyPair) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Admit straight into main queue if evicted recently
+	keyPair.Hits = 0
+	keyPair.Score = float64(time.Now().UnixNano()) / 1e9
+	if _, ok := p.ghosts[keyPair.Key]; ok {
+		delete(p.ghosts, keyPair.Key)
+		keyPair.Queue = s3fifoMain
+		return
+	}
+	keyPair.Queue = s3fifoSmall
+	p.smallSize += keyPair.Size
+}
+
+func (p *s3fifoPolicy) Hit(keyPair *KeyPair, hits int) {
+	keyPair.Hits = math.Min(keyPair.Hits+float64(hits), 3)
+}
+
+func (p *s3fifoPolicy) Order(keyPair KeyPair) (byte, float64) {
+	return byte(keyPair.Queue), keyPair.Score
+}
+
+// Start evicts from the small queue while it holds more than its share of the cache
+func (p *s3fifoPolicy) Start(cacheLimit int) []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.smallSize*100 >= cacheLimit*viper.GetInt("cache.eviction.s3fifo_small_percent") {
+		return []byte{s3fifoSmall}
+	}
+	return []byte{s3fifoMain}
+}
+
+func (p *s3fifoPolicy) Evict(keyPair *KeyPair) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Move entries hit more than once from the small queue into the main queue
+	keyPair.Score = float64(time.Now().UnixNano()) / 1e9
+	if keyPair.Queue == s3fifoSmall {
+		p.smallSize -= keyPair.Size
+		if keyPair.Hits > 1 {
+			keyPair.Queue = s3fifoMain
+			keyPair.Hits = 0
+			return false
+		}
+
+		// Remember evicted key, forgetting the oldest
+		if oldest := p.ghostOrder[p.ghostNext]; oldest != "" {
+			delete(p.ghosts, oldest)
+		}
+		p.ghostOrder[p.ghostNext] = keyPair.Key
+		p.ghostNext = (p.ghostNext + 1) % len(p.ghostOrder)
+		p.ghosts[keyPair.Key] = struct{}{}
+		return true
+	}
+
+	// Give entries of the main queue that were hit another round
+	if keyPair.Hits > 0 {
+		keyPair.Hits--
+		return false
+	}
+	return true
+}
+
+func (p *s3fifoPolicy) Reconcile() reconciler {
+	return &s3fifoReconciler{policy: p}
+}
+
+// s3fifoReconciler recounts the size of the small queue
+type s3fifoReconciler struct {
+	policy    *s3fifoPolicy
+	smallSize int
+}
+
+func (r *s3fifoReconciler) Add(keyPair KeyPair) {
+	if keyPair.Queue == s3fifoSmall {
+		r.smallSize += keyPair.Size
+	}
+}
+
+func (r *s3fifoReconciler) Finish() {
+	r.policy.mu.Lock()
+	r.policy.smallSize = r.smallSize
+	r.policy.mu.Unlock()
+}
+
+// gdsfPolicy implements GreedyDual-Size-Frequency, which favours small and frequently read entries.
+// Each entry's priority is the inflation value at its last update plus its hits per KiB, and the
+// inflation value rises to the priority of every evicted entry so that entries left alone age out.
+type gdsfPolicy struct {
+	mu        sync.Mutex
+	inflation float64
+}
+
+func (p *gdsfPolicy) Name() string                { return EvictionPolicyGDSF }
+func (p *gdsfPolicy) Start(cacheLimit int) []byte { return nil }
+
+func (p *gdsfPolicy) getPriority(keyPair KeyPair) float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inflation + keyPair.Hits*1024/float64(keyPair.Size+1)
+}
+
+func (p *gdsfPolicy) Insert(keyPair *KeyPair) {
+	keyPair.Hits = 1
+	keyPair.Score = p.getPriority(*keyPair)
+}
+
+func (p *gdsfPolicy) Hit(keyPair *KeyPair, hits int) {
+	keyPair.Hits += float64(hits)
+	keyPair.Score = p.getPriority(*keyPair)
+}
+
+func (p *gdsfPolicy) Order(keyPair KeyPair) (byte, float64) {
+	return 0, keyPair.Score
+}
+
+func (p *gdsfPolicy) Evict(keyPair *KeyPair) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if keyPair.Score > p.inflation {
+		p.inflation = keyPair.Score
+	}
+	return true
+}
+
+// Reconcile restores the inflation value after a restart from the lowest priority still cached
+func (p *gdsfPolicy) Reconcile() reconciler {
+	return &gdsfReconciler{policy: p, minimum: math.Inf(1)}
+}
+
+// gdsfReconciler raises the inflation value to the lowest priority of any entry
+type gdsfReconciler struct {
+	policy  *gdsfPolicy
+	minimum float64
+}
+
+func (r *gdsfReconciler) Add(keyPair KeyPair) {
+	if keyPair.Key != "" && keyPair.Score < r.minimum {
+		r.minimum = keyPair.Score
+	}
+}
+
+func (r *gdsfReconciler) Finish() {
+	r.policy.mu.Lock()
+	defer r.policy.mu.Unlock()
+	if !math.IsInf(r.minimum, 1) && r.minimum > r.policy.inflation {
+		r.policy.inflation = r.minimum
+	}
+}
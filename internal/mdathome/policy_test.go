@@ -0,0 +1,128 @@
+package mdathome
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// newTestPolicyCache opens a test cache using an eviction policy
+func newTestPolicyCache(t *testing.T, policy string) *Cache {
+	t.Helper()
+	viper.Set("cache.eviction_policy", policy)
+	t.Cleanup(func() {
+		viper.Set("cache.eviction_policy", nil)
+	})
+	c := newTestCache(t, 1<<30)
+	if c.policy.Name() != policy {
+		t.Fatalf("Expected %s policy, got %s", policy, c.policy.Name())
+	}
+	return c
+}
+
+// getEvictionOrder returns the names of cached images in the order they are offered up for eviction
+func getEvictionOrder(t *testing.T, c *Cache, names map[string]string) []string {
+	t.Helper()
+	var order []string
+	if err := c.forEachByEviction(nil, collectNames(names, &order)); err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+func TestLRUPolicyOrder(t *testing.T) {
+	c := newTestPolicyCache(t, EvictionPolicyLRU)
+	names := setTestImages(t, c, "a", "b", "c")
+	now := time.Now().Unix()
+	for name, age := range map[string]int64{"a": 100, "b": 300, "c": 200} {
+		updateTestEntry(t, c, name, func(keyPair *KeyPair) {
+			keyPair.Timestamp = now - age
+		})
+	}
+
+	// Least recently used entries go first
+	if order := getEvictionOrder(t, c, names); !reflect.DeepEqual(order, []string{"b", "c", "a"}) {
+		t.Fatalf("Unexpected eviction order %v", order)
+	}
+}
+
+func TestLFUPolicyOrder(t *testing.T) {
+	c := newTestPolicyCache(t, EvictionPolicyLFU)
+	names := setTestImages(t, c, "a", "b", "c", "d")
+	halfLife := int64(viper.GetInt("cache.eviction.lfu_half_life_seconds"))
+
+	// Least frequently used entries go first, with hits long ago counting for little
+	updateTestEntry(t, c, "b", func(keyPair *KeyPair) { c.policy.Hit(keyPair, 5) })
+	updateTestEntry(t, c, "c", func(keyPair *KeyPair) { c.policy.Hit(keyPair, 20) })
+	updateTestEntry(t, c, "d", func(keyPair *KeyPair) {
+		keyPair.Hits = 1000
+		keyPair.Timestamp -= 10 * halfLife
+		c.policy.Hit(keyPair, 1)
+	})
+	if order := getEvictionOrder(t, c, names); !reflect.DeepEqual(order, []string{"a", "d", "b", "c"}) {
+		t.Fatalf("Unexpected eviction order %v", order)
+	}
+}
+
+func TestS3FIFOPolicyOrder(t *testing.T) {
+	c := newTestPolicyCache(t, EvictionPolicyS3FIFO)
+	names := setTestImages(t, c, "a", "b", "c")
+
+	// New entries wait in the small queue in order of insertion
+	if order := getEvictionOrder(t, c, names); !reflect.DeepEqual(order, []string{"a", "b", "c"}) {
+		t.Fatalf("Unexpected eviction order %v", order)
+	}
+	if start := c.policy.Start(1); !bytes.Equal(start, []byte{s3fifoSmall}) {
+		t.Fatalf("Expected eviction to start from small queue while it is over its share, got %v", start)
+	}
+
+	// Entries hit more than once move to the main queue instead of being evicted
+	updateTestEntry(t, c, "b", func(keyPair *KeyPair) { c.policy.Hit(keyPair, 2) })
+	for _, name := range []string{"a", "b"} {
+		keyPair, _ := c.getEntry(hashRequestURI("/data/x/" + name + ".png"))
+		if evicted := c.evict(keyPair); evicted != (name == "a") {
+			t.Fatalf("Expected %s to be evicted %v, got %v", name, name == "a", evicted)
+		}
+	}
+
+	// Entries evicted recently come back straight into the main queue
+	setTestImages(t, c, "a")
+	if order := getEvictionOrder(t, c, names); !reflect.DeepEqual(order, []string{"c", "b", "a"}) {
+		t.Fatalf("Unexpected eviction order %v", order)
+	}
+}
+
+func TestGDSFPolicyOrder(t *testing.T) {
+	c := newTestPolicyCache(t, EvictionPolicyGDSF)
+	names := make(map[string]string)
+	for name, size := range map[string]int{"a": 100 * 1024, "b": 1024, "c": 1024} {
+		requestURI := "/data/x/" + name + ".png"
+		if err := c.Set(requestURI, time.Now(), bytes.Repeat([]byte("x"), size)); err != nil {
+			t.Fatalf("Failed to cache image %s: %v", name, err)
+		}
+		names[hashRequestURI(requestURI)] = name
+	}
+
+	// Large and rarely used entries go first
+	updateTestEntry(t, c, "c", func(keyPair *KeyPair) { c.policy.Hit(keyPair, 10) })
+	if order := getEvictionOrder(t, c, names); !reflect.DeepEqual(order, []string{"a", "b", "c"}) {
+		t.Fatalf("Unexpected eviction order %v", order)
+	}
+
+	// Evictions age entries left alone behind new ones
+	b, _ := c.getEntry(hashRequestURI("/data/x/b.png"))
+	if !c.evict(b) {
+		t.Fatalf("Expected entry to be evicted")
+	}
+	delete(names, b.Key)
+	names[hashRequestURI("/data/x/d.png")] = "d"
+	if err := c.Set("/data/x/d.png", time.Now(), bytes.Repeat([]byte("x"), 100*1024)); err != nil {
+		t.Fatalf("Failed to cache image d: %v", err)
+	}
+	if order := getEvictionOrder(t, c, names); !reflect.DeepEqual(order, []string{"a", "d", "c"}) {
+		t.Fatalf("Unexpected eviction order %v", order)
+	}
+}
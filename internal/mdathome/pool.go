@@ -0,0 +1,318 @@
+package mdathome
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// upstreamEWMAWeight is how much each new observation moves a member's latency and error rate
+const upstreamEWMAWeight = 0.1
+
+// upstreamEmptyPoolRetryAfter is how long readers are asked to wait while the pool has no members,
+// which is how often the control server is pinged for its image server
+const upstreamEmptyPoolRetryAfter = 15 * time.Second
+
+var upstreams = &upstreamPool{}
+
+// UpstreamConfig is a single `[[upstream.pool]]` entry
+type UpstreamConfig struct {
+	URL      string `mapstructure:"url"`
+	Weight   int    `mapstructure:"weight"`
+	Priority int    `mapstructure:"priority"`
+}
+
+// upstreamMember is a single image server in the pool along with its recent performance
+type upstreamMember struct {
+	url      string
+	weight   int
+	priority int
+	breaker  *circuitBreaker
+
+	mu        sync.Mutex
+	latency   float64
+	errorRate float64
+	healthy   bool
+
+	requestsTotal   *metrics.Counter
+	errorsTotal     *metrics.Counter
+	durationSeconds *metrics.Histogram
+}
+
+func newUpstreamMember(url string) *upstreamMember {
+	m := &upstreamMember{
+		url:     url,
+		breaker: &circuitBreaker{},
+		healthy: true,
+	}
+
+	// Prepare per-upstream metrics
+	m.requestsTotal = metrics.GetOrCreateCounter(m.metricName("client_upstream_requests_total"))
+	m.errorsTotal = metrics.GetOrCreateCounter(m.metricName("client_upstream_errors_total"))
+	m.durationSeconds = metrics.GetOrCreateHistogram(m.metricName("client_upstream_duration_seconds"))
+	metrics.GetOrCreateGauge(m.metricName("client_upstream_healthy"), func() float64 {
+		return boolToFloat(m.isHealthy())
+	})
+	metrics.GetOrCreateGauge(m.metricName("client_upstream_breaker_open"), func() float64 {
+		_, allowed := m.breaker.State()
+		return boolToFloat(!allowed)
+	})
+
+	return m
+}
+
+func (m *upstreamMember) metricName(name string) string {
+	return fmt.Sprintf("%s{upstream=%q}", name, m.url)
+}
+
+// unregister removes the gauges of a member that left the pool
+func (m *upstreamMember) unregister() {
+	metrics.UnregisterMetric(m.metricName("client_upstream_healthy"))
+	metrics.UnregisterMetric(m.metricName("client_upstream_breaker_open"))
+}
+
+func (m *upstreamMember) isHealthy() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.healthy
+}
+
+// observe records the outcome of a request to the member
+func (m *upstreamMember) observe(duration time.Duration, failed bool) {
+	m.requestsTotal.Inc()
+	m.durationSeconds.Update(duration.Seconds())
+	if failed {
+		m.errorsTotal.Inc()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Update moving averages, seeding latency with the first observation
+	if m.latency == 0 {
+		m.latency = duration.Seconds()
+	} else {
+		m.latency += upstreamEWMAWeight * (duration.Seconds() - m.latency)
+	}
+	m.errorRate += upstreamEWMAWeight * (boolToFloat(failed) - m.errorRate)
+}
+
+// score rates a member by weight, latency and error rate, where higher is better
+func (m *upstreamMember) score() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return float64(m.weight) / ((m.latency + 0.05) * (1 + 10*m.errorRate))
+}
+
+// upstreamPool holds every image server that images may be fetched from
+type upstreamPool struct {
+	mu      sync.RWMutex
+	members []*upstreamMember
+}
+
+// Update rebuilds the pool from the control server's image server and `upstream.pool`,
+// keeping the statistics of members that remain
+func (p *upstreamPool) Update(defaultURL string) {
+	// Read configured upstreams
+	var configs []UpstreamConfig
+	if err := viper.UnmarshalKey("upstream.pool", &configs); err != nil {
+		log.Errorf("Failed to parse upstream pool: %v", err)
+	}
+
+	// Control server's image server is always a member
+	configs = append([]UpstreamConfig{{
+		URL:      defaultURL,
+		Weight:   viper.GetInt("upstream.default_weight"),
+		Priority: viper.GetInt("upstream.default_priority"),
+	}}, configs...)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Index existing members by URL
+	existing := make(map[string]*upstreamMember)
+	for _, m := range p.members {
+		existing[m.url] = m
+	}
+
+	// Build new member list
+	members := make([]*upstreamMember, 0, len(configs))
+	for _, config := range configs {
+		url := strings.TrimSuffix(config.URL, "/")
+		if url == "" {
+			continue
+		}
+		m, ok := existing[url]
+		if !ok {
+			m = newUpstreamMember(url)
+			log.WithFields(logrus.Fields{"type": "upstream", "upstream": url}).Infof("Added upstream %s to pool", url)
+		}
+		delete(existing, url)
+
+		// Update member settings
+		m.mu.Lock()
+		m.weight = config.Weight
+		if m.weight <= 0 {
+			m.weight = 1
+		}
+		m.mu.Unlock()
+		m.priority = config.Priority
+		members = append(members, m)
+	}
+
+	// Forget members that left
+	for url, m := range existing {
+		m.unregister()
+		log.WithFields(logrus.Fields{"type": "upstream", "upstream": url}).Infof("Removed upstream %s from pool", url)
+	}
+	p.members = members
+}
+
+// Select picks a member for the next request, skipping those already tried where possible. Among
+// healthy members with an allowing circuit breaker, the best priority wins and ties are broken
+// randomly in proportion to score. It returns nil if no member is available.
+func (p *upstreamPool) Select(tried map[*upstreamMember]bool) *upstreamMember {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	// Gather best-priority candidates, relaxing health requirements if nothing qualifies
+	candidates := p.candidates(tried, true)
+	if len(candidates) == 0 {
+		candidates = p.candidates(tried, false)
+	}
+	if len(candidates) == 0 {
+		candidates = p.candidates(nil, false)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// Pick weighted by score
+	scores := make([]float64, len(candidates))
+	total := 0.0
+	for i, m := range candidates {
+		scores[i] = m.score()
+		total += scores[i]
+	}
+	pick := rand.Float64() * total
+	for i, m := range candidates {
+		if pick < scores[i] {
+			return m
+		}
+		pick -= scores[i]
+	}
+	return candidates[len(candidates)-1]
+}
+
+func (p *upstreamPool) candidates(tried map[*upstreamMember]bool, requireHealthy bool) []*upstreamMember {
+	var candidates []*upstreamMember
+	for _, m := range p.members {
+		if tried[m] {
+			continue
+		}
+		if _, allowed := m.breaker.State(); !allowed {
+			continue
+		}
+		if requireHealthy && !m.isHealthy() {
+			continue
+		}
+
+		// Keep only members of the best priority
+		if len(candidates) > 0 && m.priority > candidates[0].priority {
+			continue
+		}
+		if len(candidates) > 0 && m.priority < candidates[0].priority {
+			candidates = candidates[:0]
+		}
+		candidates = append(candidates, m)
+	}
+	return candidates
+}
+
+// RetryAfter returns how long until any member's circuit breaker lets requests through again, or until
+// the pool is refilled or rechecked if it has no usable members
+func (p *upstreamPool) RetryAfter() time.Duration {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	// Wait for next control ping if there are no members yet
+	if len(p.members) == 0 {
+		return upstreamEmptyPoolRetryAfter
+	}
+
+	var retryAfter time.Duration
+	for i, m := range p.members {
+		remaining, _ := m.breaker.State()
+		if i == 0 || remaining < retryAfter {
+			retryAfter = remaining
+		}
+	}
+
+	// Wait for next health check if members are only unhealthy
+	if retryAfter <= 0 {
+		retryAfter = time.Duration(viper.GetInt("upstream.health_check_interval_seconds")) * time.Second
+	}
+	return retryAfter
+}
+
+// checkHealth probes every member once, marking those that fail to respond as unhealthy
+func (p *upstreamPool) checkHealth() {
+	p.mu.RLock()
+	members := append([]*upstreamMember(nil), p.members...)
+	p.mu.RUnlock()
+
+	// Prepare health check client
+	healthClient := &http.Client{
+		Transport: client.Transport,
+		Timeout:   time.Duration(viper.GetInt("upstream.health_check_timeout_seconds")) * time.Second,
+	}
+
+	var wg sync.WaitGroup
+	for _, m := range members {
+		wg.Add(1)
+		go func(m *upstreamMember) {
+			defer wg.Done()
+
+			// Any response short of a server error counts as healthy
+			startTime := time.Now()
+			resp, err := healthClient.Head(m.url + viper.GetString("upstream.health_check_path"))
+			healthy := err == nil && resp.StatusCode < 500
+			if resp != nil {
+				resp.Body.Close()
+			}
+			m.observe(time.Since(startTime), !healthy)
+
+			// Log health changes
+			m.mu.Lock()
+			changed := m.healthy != healthy
+			m.healthy = healthy
+			m.mu.Unlock()
+			if changed {
+				log.WithFields(logrus.Fields{"type": "upstream", "event": "health", "upstream": m.url, "healthy": healthy, "error": err}).Warnf("Upstream %s health changed to %t", m.url, healthy)
+			}
+		}(m)
+	}
+	wg.Wait()
+}
+
+// startHealthChecks periodically probes every member of the pool
+func (p *upstreamPool) startHealthChecks() {
+	for running {
+		// Sleep till next check, disabling checks if no interval is set
+		interval := viper.GetInt("upstream.health_check_interval_seconds")
+		if interval <= 0 {
+			time.Sleep(15 * time.Second)
+			continue
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+
+		p.checkHealth()
+	}
+}
@@ -0,0 +1,238 @@
+package mdathome
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxByteRanges caps how many ranges a single request may ask for before the header is ignored
+const maxByteRanges = 16
+
+var errRangeNotSatisfiable = fmt.Errorf("range not satisfiable")
+
+// byteRange is a span of an image given by its offset and length
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.start+br.length-1, size)
+}
+
+// parseRange parses a `Range` header value against an image of the given size. A nil slice
+// means the header should be ignored and the full image served instead.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	// Only byte ranges are understood
+	if !strings.HasPrefix(header, "bytes=") {
+		return nil, nil
+	}
+
+	// Parse every range specifier, ignoring the header entirely if any is malformed
+	var ranges []byteRange
+	specs := strings.Split(strings.TrimPrefix(header, "bytes="), ",")
+	if len(specs) > maxByteRanges {
+		return nil, nil
+	}
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, nil
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		var br byteRange
+		if first == "" {
+			// Suffix range of the last N bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			br = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+					return nil, nil
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+
+			// Skip ranges starting past the end of the image
+			if start >= size {
+				continue
+			}
+			br = byteRange{start: start, length: end - start + 1}
+		}
+		ranges = append(ranges, br)
+	}
+
+	// Check if any range could be satisfied
+	if len(ranges) == 0 {
+		return nil, errRangeNotSatisfiable
+	}
+
+	// Serve the full image rather than ranges adding up to more than it
+	var total int64
+	for _, br := range ranges {
+		total += br.length
+	}
+	if total > size {
+		return nil, nil
+	}
+
+	return ranges, nil
+}
+
+// checkIfRange reports whether an `If-Range` precondition allows a range request to be honoured
+func checkIfRange(r *http.Request, etag string, modTime time.Time) bool {
+	ifRange := r.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+
+	// Entity tags must match strongly
+	if strings.HasPrefix(ifRange, `"`) {
+		return etag != "" && ifRange == etag
+	}
+	if strings.HasPrefix(ifRange, "W/") {
+		return false
+	}
+
+	// Dates must match the last modification time exactly
+	since, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	return modTime.Truncate(time.Second).Equal(since)
+}
+
+// getImageContentType returns the content type implied by an image filename
+func getImageContentType(imageFilename string) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(imageFilename)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// serveImageRanges writes an image, or the requested ranges of it, returning the number of body bytes written
+func serveImageRanges(w http.ResponseWriter, r *http.Request, content io.ReaderAt, size int64, ranges []byteRange, contentType string) (int64, error) {
+	switch {
+	case len(ranges) == 0:
+		// Serve full image
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodHead {
+			return 0, nil
+		}
+		return copyImage(w, content, 0, size)
+
+	case len(ranges) == 1:
+		// Serve single range
+		br := ranges[0]
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Range", br.contentRange(size))
+		w.Header().Set("Content-Length", strconv.FormatInt(br.length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		if r.Method == http.MethodHead {
+			return 0, nil
+		}
+		return copyImage(w, content, br.start, br.length)
+
+	default:
+		// Serve multiple ranges as multipart/byteranges, measuring its length beforehand
+		counter := &countingWriter{}
+		mw := multipart.NewWriter(counter)
+		for _, br := range ranges {
+			if _, err := mw.CreatePart(rangePartHeader(br, size, contentType)); err != nil {
+				return 0, err
+			}
+			counter.n += br.length
+		}
+		if err := mw.Close(); err != nil {
+			return 0, err
+		}
+
+		boundary := mw.Boundary()
+		w.Header().Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+		w.Header().Set("Content-Length", strconv.FormatInt(counter.n, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		if r.Method == http.MethodHead {
+			return 0, nil
+		}
+
+		// Write parts with the same boundary
+		counter = &countingWriter{w: w}
+		mw = multipart.NewWriter(counter)
+		if err := mw.SetBoundary(boundary); err != nil {
+			return counter.n, err
+		}
+		for _, br := range ranges {
+			part, err := mw.CreatePart(rangePartHeader(br, size, contentType))
+			if err != nil {
+				return counter.n, err
+			}
+			if _, err := copyImage(part, content, br.start, br.length); err != nil {
+				return counter.n, err
+			}
+		}
+		return counter.n, mw.Close()
+	}
+}
+
+// copyImage copies a span of an image, failing if the image ends before it does
+func copyImage(w io.Writer, content io.ReaderAt, start int64, length int64) (int64, error) {
+	written, err := io.CopyN(w, io.NewSectionReader(content, start, length), length)
+	if err == io.EOF {
+		return written, errImageTruncated
+	}
+	return written, err
+}
+
+func rangePartHeader(br byteRange, size int64, contentType string) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {br.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+// countingWriter counts bytes written, optionally passing them through to another writer
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.w == nil {
+		cw.n += int64(len(p))
+		return len(p), nil
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
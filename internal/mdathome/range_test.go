@@ -0,0 +1,135 @@
+package mdathome
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	for _, test := range []struct {
+		header   string
+		expected []byteRange
+		err      error
+	}{
+		{"", nil, nil},
+		{"items=0-1", nil, nil},
+		{"bytes=0-99", []byteRange{{0, 100}}, nil},
+		{"bytes=100-", []byteRange{{100, 900}}, nil},
+		{"bytes=-100", []byteRange{{900, 100}}, nil},
+		{"bytes=-2000", []byteRange{{0, 1000}}, nil},
+		{"bytes=900-2000", []byteRange{{900, 100}}, nil},
+		{"bytes=0-9, 20-29", []byteRange{{0, 10}, {20, 10}}, nil},
+		{"bytes=0-9,,2000-", []byteRange{{0, 10}}, nil},
+		{"bytes=1000-", nil, errRangeNotSatisfiable},
+		{"bytes=-0", nil, errRangeNotSatisfiable},
+		{"bytes=9-0", nil, nil},
+		{"bytes=a-b", nil, nil},
+		{"bytes=0", nil, nil},
+		{"bytes=0-599,400-999", nil, nil},
+		{"bytes=0-0,1-1,2-2,3-3,4-4,5-5,6-6,7-7,8-8,9-9,10-10,11-11,12-12,13-13,14-14,15-15,16-16", nil, nil},
+	} {
+		ranges, err := parseRange(test.header, 1000)
+		if !reflect.DeepEqual(ranges, test.expected) || err != test.err {
+			t.Errorf("%q: expected %v, %v, got %v, %v", test.header, test.expected, test.err, ranges, err)
+		}
+	}
+}
+
+func TestCheckIfRange(t *testing.T) {
+	etag := `"0123456789abcdef"`
+	modTime := time.Date(2023, 11, 14, 22, 13, 20, 500000000, time.UTC)
+	for _, test := range []struct {
+		ifRange  string
+		etag     string
+		expected bool
+	}{
+		{"", etag, true},
+		{etag, etag, true},
+		{`"other"`, etag, false},
+		{etag, "", false},
+		{"W/" + etag, etag, false},
+		{modTime.Format(http.TimeFormat), etag, true},
+		{modTime.Add(time.Second).Format(http.TimeFormat), etag, false},
+		{"yesterday", etag, false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/data/x/0.png", nil)
+		if test.ifRange != "" {
+			r.Header.Set("If-Range", test.ifRange)
+		}
+		if allowed := checkIfRange(r, test.etag, modTime); allowed != test.expected {
+			t.Errorf("%q: expected %v, got %v", test.ifRange, test.expected, allowed)
+		}
+	}
+}
+
+func TestServeImageRanges(t *testing.T) {
+	image := bytes.Repeat([]byte("0123456789"), 100)
+	serve := func(method string, ranges []byteRange) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/data/x/0.png", nil)
+		written, err := serveImageRanges(w, r, bytes.NewReader(image), int64(len(image)), ranges, "image/png")
+		if err != nil {
+			t.Fatalf("Failed to serve image: %v", err)
+		}
+		if written != int64(w.Body.Len()) {
+			t.Fatalf("Expected %d bytes to be counted, got %d", w.Body.Len(), written)
+		}
+		return w
+	}
+
+	// Full image
+	w := serve(http.MethodGet, nil)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), image) || w.Header().Get("Content-Length") != "1000" {
+		t.Fatalf("Unexpected full response %d with %d bytes", w.Code, w.Body.Len())
+	}
+
+	// Single range
+	w = serve(http.MethodGet, []byteRange{{10, 5}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "01234" || w.Header().Get("Content-Range") != "bytes 10-14/1000" {
+		t.Fatalf("Unexpected single range response %d: %q", w.Code, w.Body.String())
+	}
+
+	// Multiple ranges as multipart/byteranges of the advertised length
+	ranges := []byteRange{{0, 3}, {995, 5}}
+	w = serve(http.MethodGet, ranges)
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if w.Code != http.StatusPartialContent || err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Unexpected multiple range response %d of %s: %v", w.Code, w.Header().Get("Content-Type"), err)
+	}
+	if w.Header().Get("Content-Length") != strconv.Itoa(w.Body.Len()) {
+		t.Fatalf("Expected Content-Length %d, got %s", w.Body.Len(), w.Header().Get("Content-Length"))
+	}
+	reader := multipart.NewReader(w.Body, params["boundary"])
+	for _, br := range ranges {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("Failed to read part: %v", err)
+		}
+		data, err := io.ReadAll(part)
+		if err != nil || !bytes.Equal(data, image[br.start:br.start+br.length]) {
+			t.Fatalf("Unexpected part %q: %v", data, err)
+		}
+		if part.Header.Get("Content-Range") != br.contentRange(1000) || part.Header.Get("Content-Type") != "image/png" {
+			t.Fatalf("Unexpected part headers %v", part.Header)
+		}
+	}
+	if _, err := reader.NextPart(); err != io.EOF {
+		t.Fatalf("Expected no more parts, got %v", err)
+	}
+
+	// HEAD describes the same response without a body
+	for _, ranges := range [][]byteRange{nil, {{10, 5}}, {{0, 3}, {995, 5}}} {
+		get, head := serve(http.MethodGet, ranges), serve(http.MethodHead, ranges)
+		if head.Body.Len() != 0 || head.Code != get.Code || head.Header().Get("Content-Length") != get.Header().Get("Content-Length") {
+			t.Fatalf("Unexpected HEAD response %d of %s bytes", head.Code, head.Header().Get("Content-Length"))
+		}
+	}
+}
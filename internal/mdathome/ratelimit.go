@@ -0,0 +1,166 @@
+package mdathome
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// throttleChunkSize is the largest write granted at once, so that concurrent readers interleave fairly
+const throttleChunkSize = 16 * 1024
+
+var (
+	clientThrottledTotal        = metrics.NewCounter("client_throttled_total")
+	clientThrottledSecondsTotal = metrics.NewFloatCounter("client_throttled_seconds_total")
+)
+
+// egressLimiter enforces `client.max_speed_kbps` across every response
+var egressLimiter = newBandwidthLimiter(0)
+
+// bandwidthLimiter is a token bucket that grants bytes in the order they were asked for
+type bandwidthLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newBandwidthLimiter returns a limiter for the given bytes per second, where 0 is unlimited
+func newBandwidthLimiter(bytesPerSecond int) *bandwidthLimiter {
+	l := &bandwidthLimiter{}
+	l.SetRate(bytesPerSecond)
+	return l
+}
+
+// SetRate updates the limit in bytes per second, where 0 is unlimited
+func (l *bandwidthLimiter) SetRate(bytesPerSecond int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Allow bursts of a tenth of a second, but never less than a single chunk
+	l.rate = float64(bytesPerSecond)
+	l.burst = l.rate / 10
+	if l.burst < throttleChunkSize {
+		l.burst = throttleChunkSize
+	}
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// reserve takes n bytes worth of tokens, returning how long the caller has to wait before sending them.
+// Tokens may go into debt, which queues later callers behind earlier ones.
+func (l *bandwidthLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Nothing to do if unlimited
+	if l.rate <= 0 {
+		return 0
+	}
+
+	// Refill bucket for time elapsed since last reservation
+	now := time.Now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	} else {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	// Take tokens, waiting for any debt to be paid off
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// WaitN blocks until n bytes may be sent, or the context is cancelled
+func (l *bandwidthLimiter) WaitN(ctx context.Context, n int) error {
+	delay := l.reserve(n)
+	if delay <= 0 {
+		return nil
+	}
+
+	// Record time spent throttled
+	clientThrottledTotal.Inc()
+	clientThrottledSecondsTotal.Add(delay.Seconds())
+
+	// Wait for tokens
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Wrap returns a response writer whose body writes are throttled by the limiter
+func (l *bandwidthLimiter) Wrap(ctx context.Context, w http.ResponseWriter) http.ResponseWriter {
+	return &throttledResponseWriter{ResponseWriter: w, ctx: ctx, limiter: l}
+}
+
+// throttledWriter is a writer throttled by a limiter for background work, which is not counted as
+// client throttling
+type throttledWriter struct {
+	io.Writer
+	limiter *bandwidthLimiter
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	return writeThrottled(tw.Writer, p, func(n int) error {
+		if delay := tw.limiter.reserve(n); delay > 0 {
+			time.Sleep(delay)
+		}
+		return nil
+	})
+}
+
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	limiter *bandwidthLimiter
+}
+
+func (tw *throttledResponseWriter) Write(p []byte) (int, error) {
+	return writeThrottled(tw.ResponseWriter, p, func(n int) error {
+		return tw.limiter.WaitN(tw.ctx, n)
+	})
+}
+
+// writeThrottled writes bytes at most a chunk at a time, waiting for the turn of every chunk first
+func writeThrottled(w io.Writer, p []byte, wait func(n int) error) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// Write at most a chunk at a time
+		chunk := p
+		if len(chunk) > throttleChunkSize {
+			chunk = chunk[:throttleChunkSize]
+		}
+
+		// Wait for our turn
+		if err := wait(len(chunk)); err != nil {
+			return written, err
+		}
+
+		// Write chunk
+		n, err := w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,58 @@
+package mdathome
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimiterQueuesReservations(t *testing.T) {
+	// Unlimited limiters never wait
+	if delay := newBandwidthLimiter(0).reserve(1 << 30); delay != 0 {
+		t.Fatalf("Expected no wait when unlimited, got %s", delay)
+	}
+
+	// Bursts are granted at once, and later reservations wait behind the debt of earlier ones
+	l := newBandwidthLimiter(1000 * 1000)
+	for _, expected := range []time.Duration{0, 50 * time.Millisecond, 100 * time.Millisecond} {
+		n := 100 * 1000
+		if expected > 0 {
+			n = 50 * 1000
+		}
+		if delay := l.reserve(n); delay < expected-10*time.Millisecond || delay > expected {
+			t.Fatalf("Expected to wait about %s for %d bytes, got %s", expected, n, delay)
+		}
+	}
+
+	// Lowering the rate caps saved up tokens at the new burst
+	l = newBandwidthLimiter(10 * 1000 * 1000)
+	l.reserve(0)
+	l.SetRate(1000 * 1000)
+	if delay := l.reserve(200 * 1000); delay < 90*time.Millisecond {
+		t.Fatalf("Expected burst to shrink with rate, waited %s", delay)
+	}
+}
+
+func TestThrottledWrites(t *testing.T) {
+	l := newBandwidthLimiter(1000 * 1000)
+
+	// Writes are paced at the rate once the burst is spent
+	var buf bytes.Buffer
+	startTime := time.Now()
+	if n, err := writeThrottled(&buf, make([]byte, 300*1000), func(n int) error {
+		return l.WaitN(context.Background(), n)
+	}); n != 300*1000 || err != nil {
+		t.Fatalf("Failed to write: %d, %v", n, err)
+	}
+	if elapsed := time.Since(startTime); elapsed < 150*time.Millisecond {
+		t.Fatalf("Expected writes to take about 200ms, took %s", elapsed)
+	}
+
+	// Waiting stops once the request is gone
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.WaitN(ctx, 1000*1000); err != context.Canceled {
+		t.Fatalf("Expected wait to be cancelled, got %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package mdathome
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Behaviours available while the control server has paused this client
+const (
+	PausedModeCacheOnly   string = "cache_only"
+	PausedModeUnavailable string = "unavailable"
+)
+
+var (
+	clientPaused      atomic.Bool
+	clientCompromised atomic.Bool
+)
+
+func init() {
+	// Export client state as gauges
+	metrics.NewGauge("client_paused", func() float64 {
+		return boolToFloat(clientPaused.Load())
+	})
+	metrics.NewGauge("client_compromised", func() float64 {
+		return boolToFloat(clientCompromised.Load())
+	})
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// updateClientState applies the paused and compromised flags of a control server response
+func updateClientState(response *ServerResponse) {
+	// Prepare logger
+	log := log.WithFields(logrus.Fields{"type": "control"})
+
+	// Log paused state changes
+	if wasPaused := clientPaused.Swap(response.Paused); wasPaused != response.Paused {
+		if response.Paused {
+			log.WithFields(logrus.Fields{"event": "paused", "mode": viper.GetString("client.paused_mode")}).Warnf("Client paused by control server, serving in '%s' mode", viper.GetString("client.paused_mode"))
+		} else {
+			log.WithFields(logrus.Fields{"event": "resumed"}).Warnf("Client resumed by control server")
+		}
+	}
+
+	// Compromised clients stay compromised until restarted
+	if response.Compromised && !clientCompromised.Swap(true) {
+		handleCompromised()
+	}
+}
+
+// handleCompromised stops serving requests and wipes the TLS private key from memory
+func handleCompromised() {
+	// Alert loudly
+	log := log.WithFields(logrus.Fields{"type": "control", "event": "compromised"})
+	log.Error("########################################################################")
+	log.Error("# CONTROL SERVER REPORTS THIS CLIENT AS COMPROMISED!                   #")
+	log.Error("# All requests are now refused and the TLS private key has been wiped. #")
+	log.Error("# Investigate this machine and rotate your client secret immediately!  #")
+	log.Error("########################################################################")
+
+	// Wipe TLS private key
+	if certHandler != nil {
+		certHandler.wipeCertificate()
+	}
+	serverResponse.TLS.PrivateKey = ""
+}
+
+// checkClientState rejects a request if the client is compromised or paused into unavailability.
+// It returns true if the request was rejected.
+func checkClientState(w http.ResponseWriter) bool {
+	// Refuse everything if compromised
+	if clientCompromised.Load() {
+		w.Header().Set("Connection", "close")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return true
+	}
+
+	// Refuse everything if paused and configured to be unavailable
+	if clientPaused.Load() && viper.GetString("client.paused_mode") == PausedModeUnavailable {
+		writeRetryAfter(w, viper.GetInt("client.paused_retry_after_seconds"))
+		return true
+	}
+
+	return false
+}
+
+// writeRetryAfter responds with 503 Service Unavailable and a Retry-After header
+func writeRetryAfter(w http.ResponseWriter, seconds int) {
+	if seconds > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
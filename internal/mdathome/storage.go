@@ -0,0 +1,94 @@
+package mdathome
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Storage backends selectable through `cache.backend`
+const (
+	StorageBackendFilesystem = "filesystem"
+	StorageBackendS3         = "s3"
+	StorageBackendMemory     = "memory"
+)
+
+// StorageInfo describes a stored image
+type StorageInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// StorageObject is a stored image opened for reading
+type StorageObject interface {
+	io.Reader
+	io.ReaderAt
+	io.Closer
+}
+
+// StorageWriter streams an image into storage, only making it visible once committed. Bytes already
+// written can be read back until the writer is closed, even after it has been committed.
+type StorageWriter interface {
+	io.Writer
+	io.ReaderAt
+	io.Closer
+
+	// Commit makes the image visible with the given modification time
+	Commit(mtime time.Time) error
+}
+
+// Storage holds the bytes of cached images by cache key, leaving bookkeeping to the database
+type Storage interface {
+	// Get opens a stored image for reading
+	Get(key string) (StorageObject, StorageInfo, error)
+
+	// Open opens a stored image for reading without describing it, for when its entry already does
+	Open(key string) (StorageObject, error)
+
+	// Put returns a writer that streams an image into storage
+	Put(key string) (StorageWriter, error)
+
+	// Delete removes a stored image
+	Delete(key string) error
+
+	// Stat describes a stored image without opening it
+	Stat(key string) (StorageInfo, error)
+
+	// Iterate calls fn for every stored image, stopping at the first error
+	Iterate(fn func(info StorageInfo) error) error
+}
+
+// newStorage returns the storage backend configured by `cache.backend`
+func newStorage() (Storage, error) {
+	switch backend := viper.GetString("cache.backend"); backend {
+	case StorageBackendFilesystem, "":
+		return newFilesystemStorage(viper.GetString("cache.directory")), nil
+	case StorageBackendS3:
+		return newS3Storage()
+	case StorageBackendMemory:
+		return newMemoryStorage(), nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend '%s'", backend)
+	}
+}
+
+// isCacheKey reports whether a name looks like a hashed cache key rather than a stray file
+func isCacheKey(name string) bool {
+	if len(name) != 32 {
+		return false
+	}
+	for _, c := range name {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// getShardedPath returns the path of a cache key split into three levels of subfolders
+func getShardedPath(key string) string {
+	return key[0:2] + "/" + key[2:4] + "/" + key[4:6] + "/" + key
+}
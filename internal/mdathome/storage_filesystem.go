@@ -0,0 +1,588 @@
+package mdathome
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/spf13/viper"
+)
+
+// Storage tiers that cache roots can belong to
+const (
+	CacheTierFast = "fast"
+	CacheTierSlow = "slow"
+)
+
+// Durability levels selectable through `cache.durability`
+const (
+	CacheDurabilityNone = "none"
+	CacheDurabilityFile = "file"
+	CacheDurabilityFull = "full"
+)
+
+// CacheRootConfig is a single `[[cache.roots]]` entry
+type CacheRootConfig struct {
+	Path          string `mapstructure:"path"`
+	SizeMebibytes int    `mapstructure:"size_mebibytes"`
+	Tier          string `mapstructure:"tier"`
+}
+
+// cacheRoot is a single directory, usually on its own disk, that images are spread across
+type cacheRoot struct {
+	path     string
+	tier     string
+	capacity int64
+	size     atomic.Int64
+	failed   atomic.Bool
+}
+
+func newCacheRoot(path string, tier string, capacity int64) *cacheRoot {
+	root := &cacheRoot{path: path, tier: tier, capacity: capacity}
+
+	// Prepare per-root metrics
+	metrics.GetOrCreateGauge(root.metricName("client_cache_root_size_bytes"), func() float64 {
+		return float64(root.size.Load())
+	})
+	metrics.GetOrCreateGauge(root.metricName("client_cache_root_limit_bytes"), func() float64 {
+		return float64(root.capacity)
+	})
+	metrics.GetOrCreateGauge(root.metricName("client_cache_root_failed"), func() float64 {
+		return boolToFloat(root.failed.Load())
+	})
+
+	return root
+}
+
+func (r *cacheRoot) metricName(name string) string {
+	return fmt.Sprintf("%s{root=%q}", name, r.path)
+}
+
+// isFull reports whether the root has reached its capacity, where a capacity of 0 is unbounded
+func (r *cacheRoot) isFull() bool {
+	return r.capacity > 0 && r.size.Load() >= r.capacity
+}
+
+// score returns the weighted rendezvous hashing score of a key on this root, where higher wins
+func (r *cacheRoot) score(key string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(r.path))
+	h.Write([]byte(key))
+
+	// Map hash into (0, 1) and weight by capacity
+	unit := (float64(h.Sum64()>>11) + 0.5) / float64(1<<53)
+	weight := float64(r.capacity)
+	if weight <= 0 {
+		weight = 1
+	}
+	return -weight / math.Log(unit)
+}
+
+// isDiskFailure reports whether an error means a disk can no longer be used, rather than a missing file
+func isDiskFailure(err error) bool {
+	return errors.Is(err, syscall.EIO) || errors.Is(err, syscall.EROFS) || errors.Is(err, syscall.ENODEV) || errors.Is(err, syscall.ENXIO)
+}
+
+// filesystemStorage keeps images in md5-sharded subfolders of one or more cache roots, placing
+// each key on a root by weighted rendezvous hashing so that adding or losing a root only moves
+// the keys that belonged to it
+type filesystemStorage struct {
+	roots []*cacheRoot
+
+	// Guards moving images between tiers against concurrent writes and deletes
+	mu sync.Mutex
+
+	// Hits on slow tier images, which are promoted once hit often enough
+	slowHitsMu sync.Mutex
+	slowHits   map[string]int
+	promotions chan string
+
+	// migrationLimiter enforces `cache.tiering.migration_speed_kbps`
+	migrationLimiter *bandwidthLimiter
+
+	// onRootFailed is called when a root fails so that the keys that were on it can be forgotten
+	onRootFailed func(lost func(key string) bool)
+
+	// onSynced is called with every file or folder about to be flushed to disk, so that the order of
+	// writes can be followed
+	onSynced func(path string)
+
+	// cleaned is closed once temporary files left behind by a crash have been removed
+	cleaned chan struct{}
+}
+
+func newFilesystemStorage(directory string) *filesystemStorage {
+	s := &filesystemStorage{
+		slowHits:         make(map[string]int),
+		promotions:       make(chan string, 1024),
+		migrationLimiter: newBandwidthLimiter(viper.GetInt("cache.tiering.migration_speed_kbps") * 1000 / 8),
+		cleaned:          make(chan struct{}),
+	}
+
+	// Read configured roots, falling back to the cache directory
+	var configs []CacheRootConfig
+	if err := viper.UnmarshalKey("cache.roots", &configs); err != nil {
+		log.Errorf("Failed to parse cache roots: %v", err)
+	}
+	if len(configs) == 0 {
+		configs = []CacheRootConfig{{Path: directory, SizeMebibytes: viper.GetInt(KeyCacheSize)}}
+	}
+
+	// Prepare roots, marking those that cannot be created as failed
+	for _, config := range configs {
+		if config.Tier == "" {
+			config.Tier = CacheTierFast
+		}
+		if config.Tier != CacheTierFast && config.Tier != CacheTierSlow {
+			log.Errorf("Cache root '%s' has unknown tier '%s', using '%s'", config.Path, config.Tier, CacheTierFast)
+			config.Tier = CacheTierFast
+		}
+		root := newCacheRoot(config.Path, config.Tier, int64(config.SizeMebibytes)*1024*1024)
+		if err := os.MkdirAll(root.path, os.ModePerm); err != nil {
+			log.Errorf("Cache root '%s' is unusable and will be skipped: %v", root.path, err)
+			root.failed.Store(true)
+		}
+		s.roots = append(s.roots, root)
+	}
+
+	// Clean up after any previous crash in the background
+	go s.removeTemporaryFiles(time.Now())
+
+	return s
+}
+
+// removeTemporaryFiles deletes temporary files left behind by writes and migrations that were
+// interrupted, skipping those of writes started since startup
+func (s *filesystemStorage) removeTemporaryFiles(startTime time.Time) {
+	defer close(s.cleaned)
+	removed := 0
+	for _, root := range s.roots {
+		if root.failed.Load() {
+			continue
+		}
+		if err := filepath.WalkDir(root.path, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				return nil
+			}
+
+			// Migrations only start once cleaned up, so any migration file is left over
+			if !strings.HasSuffix(entry.Name(), ".migrating") {
+				if !strings.HasSuffix(entry.Name(), ".tmp") {
+					return nil
+				}
+				if fileInfo, err := entry.Info(); err != nil || !fileInfo.ModTime().Before(startTime) {
+					return nil
+				}
+			}
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			removed++
+			return nil
+		}); err != nil {
+			log.Errorf("Failed to remove temporary files from cache root '%s': %v", root.path, err)
+			s.fail(root, err)
+		}
+	}
+	if removed > 0 {
+		log.Infof("Removed %d temporary files left behind by interrupted writes", removed)
+	}
+}
+
+// syncFile flushes a written file to disk unless `cache.durability` is none
+func (s *filesystemStorage) syncFile(file *os.File) error {
+	if viper.GetString("cache.durability") == CacheDurabilityNone {
+		return nil
+	}
+	if s.onSynced != nil {
+		s.onSynced(file.Name())
+	}
+	return file.Sync()
+}
+
+// syncDirectory flushes renames within a folder to disk if `cache.durability` is full, which is not
+// possible on Windows
+func (s *filesystemStorage) syncDirectory(path string) error {
+	if viper.GetString("cache.durability") != CacheDurabilityFull || runtime.GOOS == "windows" {
+		return nil
+	}
+	if s.onSynced != nil {
+		s.onSynced(path)
+	}
+	directory, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer directory.Close()
+	return directory.Sync()
+}
+
+// rankRoots returns the roots a key may be placed on in order of preference
+func (s *filesystemStorage) rankRoots(key string, usable func(root *cacheRoot) bool) []*cacheRoot {
+	roots := make([]*cacheRoot, 0, len(s.roots))
+	for _, root := range s.roots {
+		if usable(root) {
+			roots = append(roots, root)
+		}
+	}
+	sort.Slice(roots, func(i, j int) bool {
+		return roots[i].score(key) > roots[j].score(key)
+	})
+	return roots
+}
+
+// getRoots returns the usable roots in order of preference for a key
+func (s *filesystemStorage) getRoots(key string) []*cacheRoot {
+	return s.rankRoots(key, func(root *cacheRoot) bool {
+		return !root.failed.Load()
+	})
+}
+
+// getTierRoots returns the usable roots of a tier in order of preference for a key
+func (s *filesystemStorage) getTierRoots(key string, tier string) []*cacheRoot {
+	return s.rankRoots(key, func(root *cacheRoot) bool {
+		return root.tier == tier && !root.failed.Load()
+	})
+}
+
+// isTiered reports whether any slow tier roots are configured
+func (s *filesystemStorage) isTiered() bool {
+	for _, root := range s.roots {
+		if root.tier == CacheTierSlow {
+			return true
+		}
+	}
+	return false
+}
+
+// getTierUsage returns the total size and capacity of the usable roots of a tier
+func (s *filesystemStorage) getTierUsage(tier string) (int64, int64) {
+	var size, capacity int64
+	for _, root := range s.roots {
+		if root.tier == tier && !root.failed.Load() {
+			size += root.size.Load()
+			capacity += root.capacity
+		}
+	}
+	return size, capacity
+}
+
+// isLost reports whether a key can no longer be found on any usable root, such as once the root it
+// was placed on, preferred or not, has failed
+func (s *filesystemStorage) isLost(key string) bool {
+	_, _, err := s.find(key)
+	return errors.Is(err, os.ErrNotExist)
+}
+
+// getPath returns the parent folder and path of a cache key on a root
+func (s *filesystemStorage) getPath(root *cacheRoot, key string) (string, string) {
+	path := root.path + "/" + getShardedPath(key)
+	return filepath.Dir(path), path
+}
+
+// fail marks a root as failed if an error means its disk is gone, forgetting every key on it
+func (s *filesystemStorage) fail(root *cacheRoot, err error) {
+	if !isDiskFailure(err) || root.failed.Swap(true) {
+		return
+	}
+	log.Errorf("Cache root '%s' failed and its images will be treated as missing: %v", root.path, err)
+	if s.onRootFailed != nil {
+		go s.onRootFailed(s.isLost)
+	}
+	root.size.Store(0)
+}
+
+// find returns the root holding a key and its file information
+func (s *filesystemStorage) find(key string) (*cacheRoot, os.FileInfo, error) {
+	for _, root := range s.getRoots(key) {
+		_, path := s.getPath(root, key)
+		fileInfo, err := os.Stat(path)
+		if err == nil {
+			return root, fileInfo, nil
+		}
+		if !os.IsNotExist(err) {
+			s.fail(root, err)
+		}
+	}
+	return nil, nil, fmt.Errorf("image '%s' not found: %w", key, os.ErrNotExist)
+}
+
+func (s *filesystemStorage) Get(key string) (StorageObject, StorageInfo, error) {
+	root, _, err := s.find(key)
+	if err != nil {
+		return nil, StorageInfo{}, err
+	}
+	_, path := s.getPath(root, key)
+	if root.tier == CacheTierSlow {
+		s.recordSlowHit(key)
+	}
+
+	// Read image from directory
+	file, err := os.Open(path)
+	if err != nil {
+		s.fail(root, err)
+		return nil, StorageInfo{}, fmt.Errorf("failed to read image from '%s': %v", path, err)
+	}
+
+	// Get file information
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		s.fail(root, err)
+		return nil, StorageInfo{}, fmt.Errorf("failed to retrieve file information from '%s': %v", path, err)
+	}
+
+	return file, StorageInfo{Key: key, Size: fileInfo.Size(), ModTime: fileInfo.ModTime()}, nil
+}
+
+func (s *filesystemStorage) Open(key string) (StorageObject, error) {
+	// Open image off the first root holding it
+	for _, root := range s.getRoots(key) {
+		_, path := s.getPath(root, key)
+		file, err := os.Open(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				s.fail(root, err)
+			}
+			continue
+		}
+		if root.tier == CacheTierSlow {
+			s.recordSlowHit(key)
+		}
+		return file, nil
+	}
+	return nil, fmt.Errorf("image '%s' not found: %w", key, os.ErrNotExist)
+}
+
+func (s *filesystemStorage) Put(key string) (StorageWriter, error) {
+	// Pick most preferred root with space left, otherwise the most preferred root, preferring the fast tier
+	roots := s.getTierRoots(key, CacheTierFast)
+	if len(roots) == 0 {
+		roots = s.getRoots(key)
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("no usable cache roots")
+	}
+	root := roots[0]
+	for _, candidate := range roots {
+		if !candidate.isFull() {
+			root = candidate
+			break
+		}
+	}
+	parent, path := s.getPath(root, key)
+
+	// Create necessary cache subfolder
+	if err := os.MkdirAll(parent, os.ModePerm); err != nil {
+		s.fail(root, err)
+		return nil, fmt.Errorf("failed to create parent folder '%s': %v", parent, err)
+	}
+
+	// Create temporary file in the same folder so that it can be renamed into place
+	file, err := os.CreateTemp(parent, key+".*.tmp")
+	if err != nil {
+		s.fail(root, err)
+		return nil, fmt.Errorf("failed to create temporary file at '%s': %v", parent, err)
+	}
+
+	return &filesystemWriter{storage: s, root: root, key: key, file: file, path: path}, nil
+}
+
+func (s *filesystemStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	root, fileInfo, err := s.find(key)
+	if err != nil {
+		return err
+	}
+	_, path := s.getPath(root, key)
+	if err := os.Remove(path); err != nil {
+		s.fail(root, err)
+		return err
+	}
+	root.size.Add(-1 * fileInfo.Size())
+	return nil
+}
+
+func (s *filesystemStorage) Stat(key string) (StorageInfo, error) {
+	_, fileInfo, err := s.find(key)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	return StorageInfo{Key: key, Size: fileInfo.Size(), ModTime: fileInfo.ModTime()}, nil
+}
+
+func (s *filesystemStorage) Iterate(fn func(info StorageInfo) error) error {
+	for _, root := range s.roots {
+		if root.failed.Load() {
+			continue
+		}
+		if err := filepath.WalkDir(root.path, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			// Skip folders, the database and temporary files
+			if entry.IsDir() || !isCacheKey(entry.Name()) {
+				return nil
+			}
+
+			// Describe image
+			fileInfo, err := entry.Info()
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			return fn(StorageInfo{Key: entry.Name(), Size: fileInfo.Size(), ModTime: fileInfo.ModTime()})
+		}); err != nil {
+			s.fail(root, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// resetSizes returns a reconciler recomputing the size of every root from the entries in the database,
+// assuming that each key sits on its most preferred root within the tier recorded in its entry
+func (s *filesystemStorage) resetSizes() reconciler {
+	return &rootSizeReconciler{storage: s, tiered: s.isTiered(), sizes: make(map[*cacheRoot]int64)}
+}
+
+// rootSizeReconciler sums the entries on every root
+type rootSizeReconciler struct {
+	storage *filesystemStorage
+	tiered  bool
+	sizes   map[*cacheRoot]int64
+}
+
+func (r *rootSizeReconciler) Add(keyPair KeyPair) {
+	// Look up entries written before their tier was recorded
+	if r.tiered && keyPair.Tier == "" {
+		if root, _, err := r.storage.find(keyPair.Key); err == nil {
+			r.sizes[root] += int64(keyPair.Size)
+		}
+		return
+	}
+
+	roots := r.storage.getRoots(keyPair.Key)
+	if r.tiered {
+		roots = r.storage.getTierRoots(keyPair.Key, keyPair.Tier)
+	}
+	if len(roots) > 0 {
+		r.sizes[roots[0]] += int64(keyPair.Size)
+	}
+}
+
+func (r *rootSizeReconciler) Finish() {
+	for _, root := range r.storage.roots {
+		root.size.Store(r.sizes[root])
+	}
+}
+
+// removeCopies deletes copies of an image on every root but the one it was just moved into place on,
+// so that an older copy cannot be read or migrated back. The caller must hold s.mu.
+func (s *filesystemStorage) removeCopies(key string, kept *cacheRoot) {
+	for _, root := range s.roots {
+		if root == kept || root.failed.Load() {
+			continue
+		}
+		_, path := s.getPath(root, key)
+		fileInfo, err := os.Stat(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				s.fail(root, err)
+			}
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			s.fail(root, err)
+			continue
+		}
+		root.size.Add(-1 * fileInfo.Size())
+	}
+}
+
+// filesystemWriter streams an image into a temporary file that is renamed into place on commit
+type filesystemWriter struct {
+	storage   *filesystemStorage
+	root      *cacheRoot
+	key       string
+	file      *os.File
+	path      string
+	size      int64
+	committed bool
+}
+
+func (w *filesystemWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	if err != nil {
+		w.storage.fail(w.root, err)
+	}
+	return n, err
+}
+
+func (w *filesystemWriter) ReadAt(p []byte, off int64) (int, error) {
+	return w.file.ReadAt(p, off)
+}
+
+func (w *filesystemWriter) Commit(mtime time.Time) error {
+	// Set modification time and flush image to disk before it becomes visible
+	if err := os.Chtimes(w.file.Name(), mtime, mtime); err != nil {
+		w.storage.fail(w.root, err)
+		return fmt.Errorf("failed to set modification time of image '%s': %v", w.file.Name(), err)
+	}
+	if err := w.storage.syncFile(w.file); err != nil {
+		w.storage.fail(w.root, err)
+		return fmt.Errorf("failed to flush image '%s': %v", w.file.Name(), err)
+	}
+
+	// Move image into place, replacing any copy of it including one being migrated
+	w.storage.mu.Lock()
+	var replaced int64
+	if fileInfo, err := os.Stat(w.path); err == nil {
+		replaced = fileInfo.Size()
+	}
+	if err := os.Rename(w.file.Name(), w.path); err != nil {
+		w.storage.mu.Unlock()
+		w.storage.fail(w.root, err)
+		return fmt.Errorf("failed to move image into place at '%s': %v", w.path, err)
+	}
+	w.committed = true
+	w.root.size.Add(w.size - replaced)
+	w.storage.removeCopies(w.key, w.root)
+	w.storage.mu.Unlock()
+	if err := w.storage.syncDirectory(filepath.Dir(w.path)); err != nil {
+		w.storage.fail(w.root, err)
+		return fmt.Errorf("failed to flush folder of image '%s': %v", w.path, err)
+	}
+	return nil
+}
+
+func (w *filesystemWriter) Close() error {
+	err := w.file.Close()
+	if !w.committed {
+		if removeErr := os.Remove(w.file.Name()); removeErr != nil {
+			log.Warnf("Failed to remove uncommitted image '%s': %v", w.file.Name(), removeErr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,108 @@
+package mdathome
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// memoryStorage keeps images in memory, which is mostly useful for testing
+type memoryStorage struct {
+	mu      sync.RWMutex
+	objects map[string]*memoryObject
+}
+
+// memoryObject is a committed image, whose data is never modified afterwards
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{objects: make(map[string]*memoryObject)}
+}
+
+func (s *memoryStorage) Get(key string) (StorageObject, StorageInfo, error) {
+	s.mu.RLock()
+	object, ok := s.objects[key]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, StorageInfo{}, fmt.Errorf("failed to read image '%s': %w", key, os.ErrNotExist)
+	}
+	return memoryReader{bytes.NewReader(object.data)}, StorageInfo{Key: key, Size: int64(len(object.data)), ModTime: object.modTime}, nil
+}
+
+func (s *memoryStorage) Open(key string) (StorageObject, error) {
+	object, _, err := s.Get(key)
+	return object, err
+}
+
+func (s *memoryStorage) Put(key string) (StorageWriter, error) {
+	return &memoryWriter{storage: s, key: key}, nil
+}
+
+func (s *memoryStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objects[key]; !ok {
+		return os.ErrNotExist
+	}
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *memoryStorage) Stat(key string) (StorageInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	object, ok := s.objects[key]
+	if !ok {
+		return StorageInfo{}, os.ErrNotExist
+	}
+	return StorageInfo{Key: key, Size: int64(len(object.data)), ModTime: object.modTime}, nil
+}
+
+func (s *memoryStorage) Iterate(fn func(info StorageInfo) error) error {
+	// Snapshot images so that fn may modify storage
+	s.mu.RLock()
+	infos := make([]StorageInfo, 0, len(s.objects))
+	for key, object := range s.objects {
+		infos = append(infos, StorageInfo{Key: key, Size: int64(len(object.data)), ModTime: object.modTime})
+	}
+	s.mu.RUnlock()
+
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memoryReader is a stored image being read from memory
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (r memoryReader) Close() error {
+	return nil
+}
+
+// memoryWriter buffers an image until it is committed into memory
+type memoryWriter struct {
+	memorySpool
+	storage *memoryStorage
+	key     string
+}
+
+func (w *memoryWriter) Commit(mtime time.Time) error {
+	w.mu.RLock()
+	object := &memoryObject{data: w.data[:len(w.data):len(w.data)], modTime: mtime}
+	w.mu.RUnlock()
+
+	w.storage.mu.Lock()
+	w.storage.objects[w.key] = object
+	w.storage.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,451 @@
+package mdathome
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// s3Storage keeps images in an S3-compatible object store using path-style requests signed with AWS Signature Version 4
+type s3Storage struct {
+	endpoint        *url.URL
+	bucket          string
+	prefix          string
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	client          *http.Client
+}
+
+func newS3Storage() (*s3Storage, error) {
+	// Parse endpoint
+	endpoint, err := url.Parse(strings.TrimSuffix(viper.GetString("cache.s3.endpoint"), "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint '%s': %v", viper.GetString("cache.s3.endpoint"), err)
+	}
+	if viper.GetString("cache.s3.bucket") == "" {
+		return nil, fmt.Errorf("no S3 bucket configured")
+	}
+
+	// Bound waiting for responses rather than whole requests, as bodies are streamed to readers at their pace
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = time.Duration(viper.GetInt("cache.s3.timeout_seconds")) * time.Second
+
+	return &s3Storage{
+		endpoint:        endpoint,
+		bucket:          viper.GetString("cache.s3.bucket"),
+		prefix:          strings.Trim(viper.GetString("cache.s3.prefix"), "/"),
+		region:          viper.GetString("cache.s3.region"),
+		accessKeyID:     viper.GetString("cache.s3.access_key_id"),
+		secretAccessKey: viper.GetString("cache.s3.secret_access_key"),
+		client:          &http.Client{Transport: transport},
+	}, nil
+}
+
+// getObjectName returns the object name of a cache key, sharded like the filesystem backend
+func (s *s3Storage) getObjectName(key string) string {
+	if s.prefix == "" {
+		return getShardedPath(key)
+	}
+	return s.prefix + "/" + getShardedPath(key)
+}
+
+// newRequest prepares a signed request for an object, or for the bucket if objectName is empty
+func (s *s3Storage) newRequest(method string, objectName string, query url.Values, header http.Header, body []byte) (*http.Request, error) {
+	payloadHash := sha256.Sum256(body)
+	return s.newStreamingRequest(method, objectName, query, header, bytes.NewReader(body), int64(len(body)), hex.EncodeToString(payloadHash[:]))
+}
+
+// newStreamingRequest prepares a signed request whose body is read as it is sent, given its size and
+// hexadecimal SHA-256
+func (s *s3Storage) newStreamingRequest(method string, objectName string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Request, error) {
+	// Build path-style URL
+	u := *s.endpoint
+	u.Path = s.endpoint.Path + "/" + s.bucket
+	if objectName != "" {
+		u.Path += "/" + objectName
+	}
+	u.RawQuery = encodeS3Query(query)
+
+	// Create request
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	// Sign payload
+	s.sign(req, payloadHash, time.Now())
+	return req, nil
+}
+
+// encodeS3Query encodes a query string sorted by key with spaces as %20, as Signature Version 4 expects
+func encodeS3Query(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+// sign adds Signature Version 4 authorisation headers to a request
+func (s *s3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	// Set signed headers
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Build canonical headers, including host
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// Build canonical request
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	// Build string to sign
+	scope := amzDate[:8] + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	// Derive signing key and sign
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretAccessKey), amzDate[:8])
+	signingKey = hmacSHA256(signingKey, s.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// do sends a request, turning unexpected statuses into errors
+func (s *s3Storage) do(req *http.Request, expected ...int) (*http.Response, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	resp.Body.Close()
+
+	// Translate missing objects for callers checking os.IsNotExist
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	return nil, fmt.Errorf("unexpected status from S3 %s %s: %s", req.Method, req.URL.Path, resp.Status)
+}
+
+// getS3Info describes an object from its response headers, preferring the modification time saved on upload
+func getS3Info(key string, header http.Header, size int64) StorageInfo {
+	info := StorageInfo{Key: key, Size: size}
+	if seconds, err := strconv.ParseInt(header.Get("X-Amz-Meta-Mtime"), 10, 64); err == nil {
+		info.ModTime = time.Unix(seconds, 0)
+	} else if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		info.ModTime = lastModified
+	}
+	return info
+}
+
+func (s *s3Storage) Get(key string) (StorageObject, StorageInfo, error) {
+	object := &s3Object{storage: s, key: key}
+	resp, err := object.fetch(0)
+	if err != nil {
+		return nil, StorageInfo{}, fmt.Errorf("failed to read image '%s': %w", key, err)
+	}
+	object.body = resp.Body
+	return object, getS3Info(key, resp.Header, resp.ContentLength), nil
+}
+
+func (s *s3Storage) Open(key string) (StorageObject, error) {
+	object, _, err := s.Get(key)
+	return object, err
+}
+
+func (s *s3Storage) Put(key string) (StorageWriter, error) {
+	// Spool image to disk unless images may be held in memory
+	var spool fetchSpool = &memorySpool{}
+	if viper.GetBool("performance.low_memory_mode") {
+		file, err := os.CreateTemp("", key+".*.tmp")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temporary file: %v", err)
+		}
+		spool = &fileSpool{file: file}
+	}
+	return &s3Writer{spool: spool, hasher: sha256.New(), storage: s, key: key}, nil
+}
+
+func (s *s3Storage) Delete(key string) error {
+	req, err := s.newRequest(http.MethodDelete, s.getObjectName(key), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *s3Storage) Stat(key string) (StorageInfo, error) {
+	req, err := s.newRequest(http.MethodHead, s.getObjectName(key), nil, nil, nil)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	resp, err := s.do(req, http.StatusOK)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	resp.Body.Close()
+	return getS3Info(key, resp.Header, resp.ContentLength), nil
+}
+
+// s3ListBucketResult is the subset of a ListObjectsV2 response that is used
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *s3Storage) Iterate(fn func(info StorageInfo) error) error {
+	query := url.Values{"list-type": {"2"}}
+	if s.prefix != "" {
+		query.Set("prefix", s.prefix+"/")
+	}
+
+	for {
+		// List next page of objects
+		req, err := s.newRequest(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := s.do(req, http.StatusOK)
+		if err != nil {
+			return fmt.Errorf("failed to list objects: %v", err)
+		}
+		var result s3ListBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to parse object list: %v", err)
+		}
+
+		// Describe images
+		for _, object := range result.Contents {
+			if key := path.Base(object.Key); isCacheKey(key) {
+				if err := fn(StorageInfo{Key: key, Size: object.Size, ModTime: object.LastModified}); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Continue till last page
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// s3Object streams an object from S3, reopening it at another offset when read out of order
+type s3Object struct {
+	storage *s3Storage
+	key     string
+
+	mu       sync.Mutex
+	body     io.ReadCloser
+	position int64
+	offset   int64
+}
+
+// fetch requests an object from an offset onwards, returning an empty body if the offset is past its end
+func (o *s3Object) fetch(offset int64) (*http.Response, error) {
+	var header http.Header
+	if offset > 0 {
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
+	}
+	req, err := o.storage.newRequest(http.MethodGet, o.storage.getObjectName(o.key), nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.storage.do(req, http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable)
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip to offset if ranges are not supported
+	switch resp.StatusCode {
+	case http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		resp.Body = http.NoBody
+	case http.StatusOK:
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil && err != io.EOF {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// seek reopens the object at an offset unless it is already being read from there
+func (o *s3Object) seek(offset int64) error {
+	if o.body != nil && o.offset == offset {
+		return nil
+	}
+	if o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	resp, err := o.fetch(offset)
+	if err != nil {
+		return fmt.Errorf("failed to read image '%s': %w", o.key, err)
+	}
+	o.body, o.offset = resp.Body, offset
+	return nil
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.seek(o.position); err != nil {
+		return 0, err
+	}
+	n, err := o.body.Read(p)
+	o.position += int64(n)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) ReadAt(p []byte, off int64) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.seek(off); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(o.body, p)
+	o.offset += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (o *s3Object) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
+
+// s3Writer spools an image until it is uploaded on commit, as the object only exists once uploaded in
+// full and its modification time is not known before
+type s3Writer struct {
+	spool   fetchSpool
+	hasher  hash.Hash
+	size    int64
+	storage *s3Storage
+	key     string
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	n, err := w.spool.Write(p)
+	w.hasher.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *s3Writer) ReadAt(p []byte, off int64) (int, error) {
+	return w.spool.ReadAt(p, off)
+}
+
+func (w *s3Writer) Commit(mtime time.Time) error {
+	// Upload image straight from spool, saving modification time alongside it
+	header := http.Header{"X-Amz-Meta-Mtime": {strconv.FormatInt(mtime.Unix(), 10)}}
+	body := io.NewSectionReader(w.spool, 0, w.size)
+	req, err := w.storage.newStreamingRequest(http.MethodPut, w.storage.getObjectName(w.key), nil, header, body, w.size, hex.EncodeToString(w.hasher.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	resp, err := w.storage.do(req, http.StatusOK)
+	if err != nil {
+		return fmt.Errorf("failed to upload image '%s': %v", w.key, err)
+	}
+	return resp.Body.Close()
+}
+
+func (w *s3Writer) Close() error {
+	return w.spool.Close()
+}
+
+// fileSpool holds an image in a temporary file, which is removed once closed
+type fileSpool struct {
+	file *os.File
+}
+
+func (s *fileSpool) Write(p []byte) (int, error) {
+	return s.file.Write(p)
+}
+
+func (s *fileSpool) ReadAt(p []byte, off int64) (int, error) {
+	return s.file.ReadAt(p, off)
+}
+
+func (s *fileSpool) Close() error {
+	err := s.file.Close()
+	if removeErr := os.Remove(s.file.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
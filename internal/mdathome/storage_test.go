@@ -0,0 +1,399 @@
+package mdathome
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// s3StandIn is a minimal S3-compatible server holding a single bucket in memory, standing in for
+// something like MinIO
+type s3StandIn struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string]s3StandInObject
+	ranges  []string
+}
+
+type s3StandInObject struct {
+	data    []byte
+	mtime   string
+	modTime time.Time
+}
+
+func newS3StandIn(t *testing.T) *s3StandIn {
+	t.Helper()
+	s := &s3StandIn{bucket: "images", objects: make(map[string]s3StandInObject)}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+
+	// Point configuration at server
+	viper.Set("cache.s3.endpoint", server.URL)
+	viper.Set("cache.s3.bucket", s.bucket)
+	viper.Set("cache.s3.prefix", "cache")
+	viper.Set("cache.s3.access_key_id", "minioadmin")
+	viper.Set("cache.s3.secret_access_key", "minioadmin")
+	t.Cleanup(func() {
+		for _, key := range []string{"endpoint", "bucket", "prefix", "access_key_id", "secret_access_key"} {
+			viper.Set("cache.s3."+key, nil)
+		}
+	})
+	return s
+}
+
+func (s *s3StandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Refuse unsigned requests
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=minioadmin/") {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+	name, ok := strings.CutPrefix(r.URL.Path, "/"+s.bucket)
+	if !ok {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	name = strings.TrimPrefix(name, "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		s.list(w, r)
+	case r.Method == http.MethodPut:
+		// Check payload against signed checksum
+		data, err := io.ReadAll(r.Body)
+		checksum := sha256.Sum256(data)
+		if err != nil || hex.EncodeToString(checksum[:]) != r.Header.Get("X-Amz-Content-Sha256") {
+			http.Error(w, "XAmzContentSHA256Mismatch", http.StatusBadRequest)
+			return
+		}
+		s.objects[name] = s3StandInObject{data: data, mtime: r.Header.Get("X-Amz-Meta-Mtime"), modTime: time.Now()}
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := s.objects[name]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			s.ranges = append(s.ranges, r.Header.Get("Range"))
+		}
+		w.Header().Set("X-Amz-Meta-Mtime", object.mtime)
+		http.ServeContent(w, r, name, object.modTime, bytes.NewReader(object.data))
+	case r.Method == http.MethodDelete:
+		delete(s.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// list answers ListObjectsV2 a single object per page, so that continuation is exercised
+func (s *s3StandIn) list(w http.ResponseWriter, r *http.Request) {
+	var names []string
+	for name := range s.objects {
+		if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	start, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+
+	var result s3ListBucketResult
+	if start < len(names) {
+		object := s.objects[names[start]]
+		result.Contents = append(result.Contents, struct {
+			Key          string
+			Size         int64
+			LastModified time.Time
+		}{names[start], int64(len(object.data)), object.modTime})
+	}
+	if start+1 < len(names) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(start + 1)
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+// testStorage checks the behaviour every storage backend has to share
+func testStorage(t *testing.T, storage Storage) {
+	key, other := "0123456789abcdef0123456789abcdef", "fedcba9876543210fedcba9876543210"
+	image := bytes.Repeat([]byte("0123456789"), 10000)
+	mtime := time.Unix(1700000000, 0)
+
+	// Images are readable back while written, but invisible until committed
+	writer, err := storage.Put(key)
+	if err != nil {
+		t.Fatalf("Failed to prepare image: %v", err)
+	}
+	if _, err := writer.Write(image); err != nil {
+		t.Fatalf("Failed to write image: %v", err)
+	}
+	p := make([]byte, 10)
+	if n, err := writer.ReadAt(p, 20); n != 10 || err != nil || !bytes.Equal(p, image[20:30]) {
+		t.Fatalf("Failed to read back uncommitted image: %d, %v", n, err)
+	}
+	if _, err := storage.Stat(key); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected uncommitted image to be missing, got %v", err)
+	}
+	if err := writer.Commit(mtime); err != nil {
+		t.Fatalf("Failed to commit image: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	// Images closed without being committed are discarded
+	writer, err = storage.Put(other)
+	if err != nil {
+		t.Fatalf("Failed to prepare image: %v", err)
+	}
+	writer.Write(image)
+	writer.Close()
+	if _, err := storage.Stat(other); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected discarded image to be missing, got %v", err)
+	}
+
+	// Committed images are described and read in full
+	object, info, err := storage.Get(key)
+	if err != nil {
+		t.Fatalf("Failed to get image: %v", err)
+	}
+	if info.Size != int64(len(image)) || !info.ModTime.Equal(mtime) {
+		t.Fatalf("Unexpected image information %+v", info)
+	}
+	if data, err := io.ReadAll(object); err != nil || !bytes.Equal(data, image) {
+		t.Fatalf("Failed to read image: %v", err)
+	}
+	object.Close()
+	if info, err := storage.Stat(key); err != nil || info.Size != int64(len(image)) || !info.ModTime.Equal(mtime) {
+		t.Fatalf("Unexpected image information %+v: %v", info, err)
+	}
+
+	// Committed images are read at any offset in any order
+	object, err = storage.Open(key)
+	if err != nil {
+		t.Fatalf("Failed to open image: %v", err)
+	}
+	for _, off := range []int64{50000, 10, 50010, 99995} {
+		n, err := object.ReadAt(p, off)
+		end := off + int64(len(p))
+		if end > int64(len(image)) {
+			end = int64(len(image))
+		}
+		if n != int(end-off) || !bytes.Equal(p[:n], image[off:end]) || (n < len(p) && err != io.EOF) || (n == len(p) && err != nil) {
+			t.Fatalf("Unexpected read of %d bytes at %d: %v", n, off, err)
+		}
+	}
+	if n, err := object.ReadAt(p, int64(len(image))); n != 0 || err != io.EOF {
+		t.Fatalf("Expected end of image, got %d bytes: %v", n, err)
+	}
+	object.Close()
+
+	// Every image is iterated
+	var keys []string
+	if err := storage.Iterate(func(info StorageInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	}); err != nil || len(keys) != 1 || keys[0] != key {
+		t.Fatalf("Unexpected images %v: %v", keys, err)
+	}
+
+	// Deleted images are missing
+	if err := storage.Delete(key); err != nil {
+		t.Fatalf("Failed to delete image: %v", err)
+	}
+	if _, _, err := storage.Get(key); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected deleted image to be missing, got %v", err)
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, newMemoryStorage())
+}
+
+func TestFilesystemStorage(t *testing.T) {
+	setDefaultConfiguration()
+	storage := newFilesystemStorage(t.TempDir())
+	<-storage.cleaned
+	testStorage(t, storage)
+}
+
+func TestCommitFlushesPerDurability(t *testing.T) {
+	key := "0123456789abcdef0123456789abcdef"
+	mtime := time.Unix(1700000000, 0)
+	for durability, expected := range map[string][]string{
+		CacheDurabilityNone: nil,
+		CacheDurabilityFile: {"image"},
+		CacheDurabilityFull: {"image", "folder"},
+	} {
+		t.Run(durability, func(t *testing.T) {
+			setDefaultConfiguration()
+			viper.Set("cache.durability", durability)
+			t.Cleanup(func() {
+				viper.Set("cache.durability", nil)
+			})
+			storage := newFilesystemStorage(t.TempDir())
+			<-storage.cleaned
+			folder, path := storage.getPath(storage.roots[0], key)
+
+			// Images are flushed with their modification time before being moved into place, and
+			// their folder after
+			var synced []string
+			storage.onSynced = func(syncedPath string) {
+				_, err := os.Stat(path)
+				switch {
+				case syncedPath == folder && err == nil:
+					synced = append(synced, "folder")
+				case syncedPath != folder && os.IsNotExist(err):
+					if info, err := os.Stat(syncedPath); err != nil || !info.ModTime().Equal(mtime) {
+						t.Errorf("Expected modification time to be set before flushing image: %v", err)
+					}
+					synced = append(synced, "image")
+				default:
+					t.Errorf("Unexpected flush of %s", syncedPath)
+				}
+			}
+			writer, err := storage.Put(key)
+			if err != nil {
+				t.Fatalf("Failed to prepare image: %v", err)
+			}
+			defer writer.Close()
+			writer.Write([]byte("image"))
+			if err := writer.Commit(mtime); err != nil {
+				t.Fatalf("Failed to commit image: %v", err)
+			}
+			if strings.Join(synced, ",") != strings.Join(expected, ",") {
+				t.Fatalf("Expected flushes %v, got %v", expected, synced)
+			}
+			if info, err := os.Stat(path); err != nil || !info.ModTime().Equal(mtime) {
+				t.Fatalf("Unexpected image information %+v: %v", info, err)
+			}
+		})
+	}
+}
+
+func TestFailedRootForgetsImagesOnIt(t *testing.T) {
+	// Use default configuration with two throwaway roots
+	setDefaultConfiguration()
+	directory := t.TempDir()
+	viper.Set("cache.directory", directory)
+	viper.Set("cache.roots", []map[string]interface{}{
+		{"path": directory + "/a", "size_mebibytes": 100},
+		{"path": directory + "/b", "size_mebibytes": 100},
+	})
+	t.Cleanup(func() {
+		viper.Set("cache.directory", nil)
+		viper.Set("cache.roots", nil)
+	})
+	c := newCache(1 << 30)
+	t.Cleanup(c.Close)
+	storage := c.storage.(*filesystemStorage)
+	<-storage.cleaned
+
+	// Cache images, moving one off its preferred root as if that had been full
+	for i := 0; i < 8; i++ {
+		if err := c.Set(fmt.Sprintf("/data/x/%d.png", i), time.Now(), []byte("image")); err != nil {
+			t.Fatalf("Failed to cache image %d: %v", i, err)
+		}
+	}
+	moved := hashRequestURI("/data/x/0.png")
+	preferred, fallback := storage.getRoots(moved)[0], storage.getRoots(moved)[1]
+	_, from := storage.getPath(preferred, moved)
+	folder, to := storage.getPath(fallback, moved)
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(from, to); err != nil {
+		t.Fatal(err)
+	}
+
+	// Failing the fallback root forgets exactly the images on it
+	var kept []string
+	for i := 1; i < 8; i++ {
+		hash := hashRequestURI(fmt.Sprintf("/data/x/%d.png", i))
+		if root, _, _ := storage.find(hash); root == preferred {
+			kept = append(kept, hash)
+		}
+	}
+	fallback.failed.Store(true)
+	c.forgetKeys(storage.isLost)
+	if _, err := c.getEntry(moved); err == nil {
+		t.Fatalf("Expected image on failed fallback root to be forgotten")
+	}
+	for _, hash := range kept {
+		if _, err := c.getEntry(hash); err != nil {
+			t.Fatalf("Expected image on usable root to be kept, got %v", err)
+		}
+	}
+}
+
+func TestS3Storage(t *testing.T) {
+	for _, lowMemory := range []bool{false, true} {
+		t.Run("low_memory_mode="+strconv.FormatBool(lowMemory), func(t *testing.T) {
+			setDefaultConfiguration()
+			standIn := newS3StandIn(t)
+			viper.Set("performance.low_memory_mode", lowMemory)
+			t.Cleanup(func() {
+				viper.Set("performance.low_memory_mode", nil)
+			})
+
+			// Keep spooled images where they can be counted
+			spoolDirectory := t.TempDir()
+			t.Setenv("TMPDIR", spoolDirectory)
+
+			storage, err := newS3Storage()
+			if err != nil {
+				t.Fatalf("Failed to prepare storage: %v", err)
+			}
+			testStorage(t, storage)
+
+			// Reads out of order fetched ranges rather than whole images
+			if len(standIn.ranges) == 0 {
+				t.Fatalf("Expected ranged reads")
+			}
+			if entries, _ := os.ReadDir(spoolDirectory); len(entries) != 0 {
+				t.Fatalf("Expected spooled images to be removed, found %d", len(entries))
+			}
+		})
+	}
+}
+
+func TestCacheWithMemoryBackend(t *testing.T) {
+	viper.Set("cache.backend", StorageBackendMemory)
+	t.Cleanup(func() {
+		viper.Set("cache.backend", nil)
+	})
+	c := newTestCache(t, 1<<30)
+
+	// Images are served from the backend once committed
+	if err := c.Set("/data/x/0.png", time.Now(), []byte("image")); err != nil {
+		t.Fatalf("Failed to cache image: %v", err)
+	}
+	if _, ok := c.storage.(*memoryStorage); !ok {
+		t.Fatalf("Expected memory backend, got %T", c.storage)
+	}
+	object, keyPair, err := c.Get("/data/x/0.png")
+	if err != nil {
+		t.Fatalf("Failed to get image: %v", err)
+	}
+	defer object.Close()
+	if data, err := io.ReadAll(object); err != nil || string(data) != "image" || keyPair.Size != 5 {
+		t.Fatalf("Unexpected image %q: %v", data, err)
+	}
+}
@@ -0,0 +1,260 @@
+package mdathome
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+// tieringMaxTrackedHits bounds how many slow tier images have their hits counted at once
+const tieringMaxTrackedHits = 65536
+
+var (
+	clientCachePromotedTotal      = metrics.NewCounter("client_cache_promoted_total")
+	clientCacheDemotedTotal       = metrics.NewCounter("client_cache_demoted_total")
+	clientCacheMigratedBytesTotal = metrics.NewCounter("client_cache_migrated_bytes_total")
+)
+
+// errMigrationSkipped is returned when an image was replaced or deleted while it was being migrated
+var errMigrationSkipped = errors.New("image changed during migration")
+
+// recordSlowHit counts a hit on a slow tier image, queueing it for promotion once hit often enough
+func (s *filesystemStorage) recordSlowHit(key string) {
+	s.slowHitsMu.Lock()
+	defer s.slowHitsMu.Unlock()
+
+	// Forget every count rather than grow without bounds
+	if len(s.slowHits) >= tieringMaxTrackedHits {
+		s.slowHits = make(map[string]int)
+	}
+
+	// Queue for promotion, dropping it if the queue is full
+	s.slowHits[key]++
+	if s.slowHits[key] >= viper.GetInt("cache.tiering.promote_after_hits") {
+		delete(s.slowHits, key)
+		select {
+		case s.promotions <- key:
+		default:
+		}
+	}
+}
+
+// migrate moves an image onto a tier, copying it at no more than the migration speed limit. It
+// returns the number of bytes moved, which is zero if the image was already on the tier, or
+// errMigrationSkipped if the image changed while it was being copied.
+func (s *filesystemStorage) migrate(key string, tier string) (int64, error) {
+	// Find image, skipping it if already on tier
+	source, fileInfo, err := s.find(key)
+	if err != nil {
+		return 0, err
+	}
+	if source.tier == tier {
+		return 0, nil
+	}
+
+	// Pick most preferred root of tier with space left
+	var destination *cacheRoot
+	for _, root := range s.getTierRoots(key, tier) {
+		if !root.isFull() {
+			destination = root
+			break
+		}
+	}
+	if destination == nil {
+		return 0, fmt.Errorf("no %s cache roots with space left", tier)
+	}
+	_, sourcePath := s.getPath(source, key)
+	parent, destinationPath := s.getPath(destination, key)
+
+	// Copy image into temporary file beside its destination
+	if err := os.MkdirAll(parent, os.ModePerm); err != nil {
+		s.fail(destination, err)
+		return 0, fmt.Errorf("failed to create parent folder '%s': %v", parent, err)
+	}
+	if err := s.copyFile(source, sourcePath, destination, parent, key, fileInfo.ModTime()); err != nil {
+		return 0, err
+	}
+
+	// Swap copies, unless the image was deleted or replaced while it was being copied
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if current, err := os.Stat(sourcePath); err != nil || !os.SameFile(current, fileInfo) {
+		os.Remove(destinationPath + ".migrating")
+		return 0, errMigrationSkipped
+	}
+	if err := os.Rename(destinationPath+".migrating", destinationPath); err != nil {
+		os.Remove(destinationPath + ".migrating")
+		s.fail(destination, err)
+		return 0, fmt.Errorf("failed to move image into place at '%s': %v", destinationPath, err)
+	}
+	if err := s.syncDirectory(parent); err != nil {
+		s.fail(destination, err)
+	}
+	if err := os.Remove(sourcePath); err != nil {
+		os.Remove(destinationPath)
+		if os.IsNotExist(err) {
+			return 0, errMigrationSkipped
+		}
+		s.fail(source, err)
+		return 0, fmt.Errorf("failed to remove image at '%s': %v", sourcePath, err)
+	}
+
+	// Update sizes
+	source.size.Add(-1 * fileInfo.Size())
+	destination.size.Add(fileInfo.Size())
+	clientCacheMigratedBytesTotal.Add(int(fileInfo.Size()))
+	return fileInfo.Size(), nil
+}
+
+// copyFile copies an image to a `.migrating` file beside its destination at the migration speed limit
+func (s *filesystemStorage) copyFile(source *cacheRoot, sourcePath string, destination *cacheRoot, parent string, key string, mtime time.Time) error {
+	// Open both ends
+	sourceFile, err := os.Open(sourcePath)
+	if err != nil {
+		s.fail(source, err)
+		return fmt.Errorf("failed to read image from '%s': %v", sourcePath, err)
+	}
+	defer sourceFile.Close()
+	temporaryPath := parent + "/" + key + ".migrating"
+	destinationFile, err := os.Create(temporaryPath)
+	if err != nil {
+		s.fail(destination, err)
+		return fmt.Errorf("failed to create temporary file at '%s': %v", temporaryPath, err)
+	}
+
+	// Copy image, setting its modification time before flushing it to disk
+	_, err = io.Copy(&throttledWriter{Writer: destinationFile, limiter: s.migrationLimiter}, sourceFile)
+	if err == nil {
+		err = os.Chtimes(temporaryPath, mtime, mtime)
+	}
+	if err == nil {
+		err = s.syncFile(destinationFile)
+	}
+	if closeErr := destinationFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temporaryPath)
+		s.fail(destination, err)
+		return fmt.Errorf("failed to copy image to '%s': %v", temporaryPath, err)
+	}
+	return nil
+}
+
+// StartTieringThread keeps recently used images on the fast tier, promoting slow tier images that are
+// hit repeatedly and periodically demoting those that went cold or no longer fit
+func (c *Cache) StartTieringThread(storage *filesystemStorage) {
+	<-storage.cleaned
+	var demotedBefore int64
+	for {
+		// Promote images till next demotion pass
+		timer := time.NewTimer(time.Duration(viper.GetInt("cache.tiering.interval_seconds")) * time.Second)
+		for waiting := true; waiting; {
+			select {
+			case key := <-storage.promotions:
+				c.migrate(storage, key, CacheTierFast)
+			case <-timer.C:
+				waiting = false
+			}
+		}
+
+		// Apply configuration changes
+		storage.migrationLimiter.SetRate(viper.GetInt("cache.tiering.migration_speed_kbps") * 1000 / 8)
+
+		// Demote cold images
+		demotedBefore = c.demote(storage, demotedBefore)
+	}
+}
+
+// demote moves images off the fast tier, least recently used first, for as long as they are older
+// than `cache.tiering.demote_after_seconds` or the fast tier is over capacity. Images last used before
+// the given time were demoted by an earlier pass and are skipped. It returns the time that the next
+// pass may start from, which is before any image that could not be demoted.
+func (c *Cache) demote(storage *filesystemStorage, since int64) int64 {
+	threshold := time.Now().Add(-1 * time.Duration(viper.GetInt("cache.tiering.demote_after_seconds")) * time.Second).Unix()
+	next := threshold
+	size, capacity := storage.getTierUsage(CacheTierFast)
+	if err := c.forEachByAccessSince(since, func(keyPair KeyPair) bool {
+		// Stop once remaining images are warm and fit
+		if keyPair.Timestamp >= threshold && (capacity <= 0 || size <= capacity) {
+			return false
+		}
+
+		// Skip images already known to be on the slow tier
+		if keyPair.Tier == CacheTierSlow {
+			return true
+		}
+		moved, ok := c.migrate(storage, keyPair.Key, CacheTierSlow)
+		if !ok && keyPair.Timestamp < next {
+			next = keyPair.Timestamp
+		}
+		size -= moved
+		return true
+	}); err != nil {
+		log.Errorf("Failed to demote images: %v", err)
+		return since
+	}
+	return next
+}
+
+// migrate moves an image onto a tier, logging the outcome and recording the tier in its entry. It
+// returns the number of bytes moved and whether the image is now on the tier.
+func (c *Cache) migrate(storage *filesystemStorage, key string, tier string) (int64, bool) {
+	log := log.WithFields(logrus.Fields{"type": "tiering", "key": key, "tier": tier})
+	moved, err := storage.migrate(key, tier)
+	if errors.Is(err, errMigrationSkipped) {
+		log.WithFields(logrus.Fields{"event": "skipped"}).Debugf("Skipped moving %s to %s tier as it changed", key, tier)
+		return 0, false
+	} else if err != nil {
+		log.WithFields(logrus.Fields{"event": "failed", "error": err}).Debugf("Failed to move %s to %s tier: %v", key, tier, err)
+		return 0, false
+	}
+
+	// Record tier, refreshing the timestamp of promoted images so that they are not demoted straight away
+	if err := c.setTier(key, tier, moved > 0 && tier == CacheTierFast); err != nil {
+		log.Warnf("Failed to record tier of %s: %v", key, err)
+	}
+	if moved == 0 {
+		return 0, true
+	}
+
+	// Count migration
+	if tier == CacheTierFast {
+		clientCachePromotedTotal.Inc()
+	} else {
+		clientCacheDemotedTotal.Inc()
+	}
+	log.WithFields(logrus.Fields{"event": "migrated", "image_length": moved}).Debugf("Moved %s to %s tier", key, tier)
+	return moved, true
+}
+
+// setTier records the tier holding an image in its entry, optionally refreshing its timestamp
+func (c *Cache) setTier(key string, tier string, refresh bool) error {
+	return c.database.Update(func(tx *bolt.Tx) error {
+		// Skip entries deleted or already up to date
+		keyPairBytes := tx.Bucket([]byte("KEYS")).Get([]byte(key))
+		if keyPairBytes == nil {
+			return nil
+		}
+		keyPair, err := decodeKeyPair([]byte(key), keyPairBytes)
+		if err != nil {
+			return err
+		}
+		if keyPair.Tier == tier && !refresh {
+			return nil
+		}
+
+		keyPair.Tier = tier
+		if refresh {
+			keyPair.UpdateTimestamp()
+		}
+		return c.setEntryInTx(tx, keyPair)
+	})
+}
@@ -0,0 +1,132 @@
+package mdathome
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// newTestTieredCache opens a cache with a fast and a slow root without any of its background threads
+func newTestTieredCache(t *testing.T) (*Cache, *filesystemStorage) {
+	t.Helper()
+
+	// Use default configuration with throwaway roots
+	setDefaultConfiguration()
+	directory := t.TempDir()
+	viper.Set("cache.directory", directory)
+	viper.Set("cache.roots", []map[string]interface{}{
+		{"path": directory + "/fast", "size_mebibytes": 100},
+		{"path": directory + "/slow", "size_mebibytes": 1000, "tier": CacheTierSlow},
+	})
+	t.Cleanup(func() {
+		viper.Set("cache.directory", nil)
+		viper.Set("cache.roots", nil)
+	})
+
+	// Wait for clean-up like the tiering thread, which would remove files being migrated
+	c := newCache(1 << 30)
+	t.Cleanup(c.Close)
+	storage := c.storage.(*filesystemStorage)
+	<-storage.cleaned
+	return c, storage
+}
+
+func TestTieringRecordsTierAndSizes(t *testing.T) {
+	c, storage := newTestTieredCache(t)
+	fast, slow := storage.roots[0], storage.roots[1]
+	image := bytes.Repeat([]byte("x"), 1000)
+
+	// Images land on the fast tier
+	for i := 0; i < 4; i++ {
+		if err := c.Set(fmt.Sprintf("/data/x/%d.png", i), time.Now(), image); err != nil {
+			t.Fatalf("Failed to cache image %d: %v", i, err)
+		}
+	}
+	if keyPair, _ := c.getEntry(hashRequestURI("/data/x/0.png")); keyPair.Tier != CacheTierFast {
+		t.Fatalf("Expected entry on fast tier, got %q", keyPair.Tier)
+	}
+	if fast.size.Load() != 4000 || slow.size.Load() != 0 {
+		t.Fatalf("Unexpected root sizes %d and %d", fast.size.Load(), slow.size.Load())
+	}
+
+	// Cold images are demoted and remembered as such
+	for i := 0; i < 2; i++ {
+		keyPair, _ := c.getEntry(hashRequestURI(fmt.Sprintf("/data/x/%d.png", i)))
+		keyPair.Timestamp -= 2 * int64(viper.GetInt("cache.tiering.demote_after_seconds"))
+		if err := c.setEntry(keyPair); err != nil {
+			t.Fatalf("Failed to age image %d: %v", i, err)
+		}
+	}
+	since := c.demote(storage, 0)
+	if keyPair, _ := c.getEntry(hashRequestURI("/data/x/0.png")); keyPair.Tier != CacheTierSlow {
+		t.Fatalf("Expected entry on slow tier, got %q", keyPair.Tier)
+	}
+	if fast.size.Load() != 2000 || slow.size.Load() != 2000 {
+		t.Fatalf("Unexpected root sizes %d and %d after demotion", fast.size.Load(), slow.size.Load())
+	}
+
+	// Next pass starts after the images already demoted
+	demoted := clientCacheDemotedTotal.Get()
+	if next := c.demote(storage, since); next < since || clientCacheDemotedTotal.Get() != demoted {
+		t.Fatalf("Expected nothing left to demote")
+	}
+
+	// Caching a demoted image again replaces the copy on the slow tier
+	if err := c.Set("/data/x/0.png", time.Now(), image[:500]); err != nil {
+		t.Fatalf("Failed to cache image again: %v", err)
+	}
+	if root, _, err := storage.find(hashRequestURI("/data/x/0.png")); err != nil || root != fast {
+		t.Fatalf("Expected image on fast tier only, got %v", err)
+	}
+	if fast.size.Load() != 2500 || slow.size.Load() != 1000 {
+		t.Fatalf("Unexpected root sizes %d and %d after caching again", fast.size.Load(), slow.size.Load())
+	}
+
+	// Sizes are recomputed from the recorded tiers
+	fast.size.Store(0)
+	slow.size.Store(0)
+	if _, err := c.loadCacheInfo(); err != nil {
+		t.Fatalf("Failed to load cache info: %v", err)
+	}
+	if fast.size.Load() != 2500 || slow.size.Load() != 1000 {
+		t.Fatalf("Unexpected root sizes %d and %d after reconciling", fast.size.Load(), slow.size.Load())
+	}
+}
+
+func TestMigrationSkipsReplacedImage(t *testing.T) {
+	c, storage := newTestTieredCache(t)
+	fast, slow := storage.roots[0], storage.roots[1]
+	if err := c.Set("/data/x/0.png", time.Now(), bytes.Repeat([]byte("x"), 3*throttleChunkSize)); err != nil {
+		t.Fatalf("Failed to cache image: %v", err)
+	}
+	key := hashRequestURI("/data/x/0.png")
+
+	// Slow migration down so that the image is replaced while it is being copied
+	storage.migrationLimiter.SetRate(4 * throttleChunkSize)
+	done := make(chan bool)
+	go func() {
+		_, ok := c.migrate(storage, key, CacheTierSlow)
+		done <- ok
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := c.Set("/data/x/0.png", time.Now(), []byte("fresh")); err != nil {
+		t.Fatalf("Failed to cache image again: %v", err)
+	}
+	if <-done {
+		t.Fatalf("Expected migration of replaced image to be skipped")
+	}
+	if keyPair, err := c.getEntry(key); err != nil || keyPair.Tier != CacheTierFast {
+		t.Fatalf("Expected entry on fast tier, got %q: %v", keyPair.Tier, err)
+	}
+
+	// Only the fresh image is left
+	if root, _, err := storage.find(key); err != nil || root != fast {
+		t.Fatalf("Expected image on fast tier, got %v", err)
+	}
+	if fast.size.Load() != 5 || slow.size.Load() != 0 {
+		t.Fatalf("Unexpected root sizes %d and %d", fast.size.Load(), slow.size.Load())
+	}
+}
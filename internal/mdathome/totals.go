@@ -0,0 +1,93 @@
+package mdathome
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/VictoriaMetrics/metrics"
+	bolt "go.etcd.io/bbolt"
+)
+
+var clientCacheEntries = metrics.NewCounter("client_cache_entries")
+
+// getTotal reads a running total of the cache from the META bucket
+func getTotal(tx *bolt.Tx, name string) int64 {
+	value := tx.Bucket([]byte("META")).Get([]byte(name))
+	if len(value) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(value))
+}
+
+// addTotals adjusts the total size and entry count of the cache along with the entries they count
+func addTotals(tx *bolt.Tx, size int64, count int64) error {
+	if size == 0 && count == 0 {
+		return nil
+	}
+	return setTotals(tx, getTotal(tx, "size")+size, getTotal(tx, "count")+count)
+}
+
+// setTotals stores and publishes the total size and entry count of the cache
+func setTotals(tx *bolt.Tx, totalSize int64, totalCount int64) error {
+	// Store totals
+	meta := writeBucket(tx, "META")
+	if err := meta.Put([]byte("size"), binary.BigEndian.AppendUint64(nil, uint64(totalSize))); err != nil {
+		return fmt.Errorf("could not set total size: %v", err)
+	}
+	if err := meta.Put([]byte("count"), binary.BigEndian.AppendUint64(nil, uint64(totalCount))); err != nil {
+		return fmt.Errorf("could not set entry count: %v", err)
+	}
+
+	// Update Prometheus metrics once committed
+	db, txID := tx.DB(), tx.ID()
+	tx.OnCommit(func() {
+		publishTotals(db, txID, totalSize, totalCount)
+	})
+	return nil
+}
+
+// publishedTotals remembers which transaction the published totals came from, as commit handlers of
+// concurrent transactions may run out of order
+var publishedTotals struct {
+	sync.Mutex
+	db   *bolt.DB
+	txID int
+}
+
+// publishTotals updates the Prometheus metrics with the totals of a transaction, unless newer totals of
+// the same database were published already
+func publishTotals(db *bolt.DB, txID int, totalSize int64, totalCount int64) {
+	publishedTotals.Lock()
+	defer publishedTotals.Unlock()
+	if db != nil && db == publishedTotals.db && txID < publishedTotals.txID {
+		return
+	}
+	publishedTotals.db, publishedTotals.txID = db, txID
+
+	clientCacheSize.Set(uint64(max(totalSize, 0)))
+	clientCacheEntries.Set(uint64(max(totalCount, 0)))
+}
+
+// loadTotals publishes the stored totals of the cache, counting them from scratch for databases
+// created before they were kept
+func (c *Cache) loadTotals() error {
+	var totalSize, totalCount int64
+	counted := false
+	if err := c.database.View(func(tx *bolt.Tx) error {
+		counted = tx.Bucket([]byte("META")).Get([]byte("size")) != nil
+		totalSize, totalCount = getTotal(tx, "size"), getTotal(tx, "count")
+		return nil
+	}); err != nil {
+		return err
+	}
+	if !counted {
+		log.Infof("Counting cache size...")
+		_, err := c.loadCacheInfo()
+		return err
+	}
+
+	// Update Prometheus metrics
+	publishTotals(nil, 0, totalSize, totalCount)
+	return nil
+}
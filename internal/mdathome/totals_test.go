@@ -0,0 +1,66 @@
+package mdathome
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestTotalsOnlyPublishedOnCommit(t *testing.T) {
+	c := newTestCache(t, 1<<30)
+	if err := c.Set("/data/chapter/1.png", time.Now(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if clientCacheSize.Get() != 5 || clientCacheEntries.Get() != 1 {
+		t.Fatalf("expected 5 bytes in 1 entry, got %d bytes in %d entries", clientCacheSize.Get(), clientCacheEntries.Get())
+	}
+
+	// Roll back a transaction that changed the totals
+	errRollback := errors.New("rollback")
+	if err := c.database.Update(func(tx *bolt.Tx) error {
+		if err := addTotals(tx, 100, 10); err != nil {
+			return err
+		}
+		return errRollback
+	}); err != errRollback {
+		t.Fatal(err)
+	}
+	if clientCacheSize.Get() != 5 || clientCacheEntries.Get() != 1 {
+		t.Fatalf("rolled back totals were published: %d bytes in %d entries", clientCacheSize.Get(), clientCacheEntries.Get())
+	}
+}
+
+func TestIndexesRebuiltOnlyWhenIncomplete(t *testing.T) {
+	c := newTestCache(t, 1<<30)
+	if err := c.Set("/data/chapter/1.png", time.Now(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	countIndexed := func() (indexed string, accessN int) {
+		if err := c.database.View(func(tx *bolt.Tx) error {
+			indexed = string(tx.Bucket([]byte("META")).Get([]byte("indexed")))
+			accessN = tx.Bucket([]byte("ACCESS")).Stats().KeyN
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return indexed, accessN
+	}
+	if indexed, _ := countIndexed(); indexed != c.policy.Name() {
+		t.Fatalf("expected indexes to be marked complete for %s, got %q", c.policy.Name(), indexed)
+	}
+
+	// Lose index bucket and reopen
+	if err := c.database.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte("ACCESS"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	c = newCache(1 << 30)
+	t.Cleanup(c.Close)
+	if indexed, accessN := countIndexed(); indexed != c.policy.Name() || accessN != 1 {
+		t.Fatalf("expected rebuilt index of 1 entry, got %d entries marked %q", accessN, indexed)
+	}
+}
@@ -0,0 +1,271 @@
+package mdathome
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	clientTranscodedTotal           = metrics.NewCounter("client_transcoded_total")
+	clientTranscodedFailedTotal     = metrics.NewCounter("client_transcoded_failed_total")
+	clientTranscodedSavedBytesTotal = metrics.NewCounter("client_transcoded_saved_bytes_total")
+)
+
+// getPageKey returns the key shared by the `data` and `data-saver` variants of a page, which is the
+// chapter hash followed by the page's filename up to its checksum or extension
+func getPageKey(imagePath string) (string, bool) {
+	tokens := strings.Split(imagePath, "/")
+	if len(tokens) != 4 {
+		return "", false
+	}
+	page := strings.TrimSuffix(tokens[3], path.Ext(tokens[3]))
+	page, _, _ = strings.Cut(page, "-")
+	return tokens[2] + "/" + page, true
+}
+
+// setPage records the `data` image a page can be transcoded from
+func (c *Cache) setPage(requestURI string) error {
+	pageKey, ok := getPageKey(requestURI)
+	if !ok {
+		return fmt.Errorf("invalid image path '%s'", requestURI)
+	}
+	return c.database.Update(func(tx *bolt.Tx) error {
+		return writeBucket(tx, "PAGES").Put([]byte(pageKey), []byte(requestURI))
+	})
+}
+
+// getPage returns the `data` image recorded for the page of an image path
+func (c *Cache) getPage(requestURI string) (string, error) {
+	pageKey, ok := getPageKey(requestURI)
+	if !ok {
+		return "", fmt.Errorf("invalid image path '%s'", requestURI)
+	}
+
+	var original string
+	err := c.database.View(func(tx *bolt.Tx) error {
+		originalBytes := tx.Bucket([]byte("PAGES")).Get([]byte(pageKey))
+		if originalBytes == nil {
+			return fmt.Errorf("page does not exist")
+		}
+		original = string(originalBytes)
+		return nil
+	})
+	return original, err
+}
+
+// deletePage forgets the `data` image recorded for the page of an image path
+func (c *Cache) deletePage(requestURI string) error {
+	pageKey, ok := getPageKey(requestURI)
+	if !ok {
+		return fmt.Errorf("invalid image path '%s'", requestURI)
+	}
+	return c.database.Update(func(tx *bolt.Tx) error {
+		return writeBucket(tx, "PAGES").Delete([]byte(pageKey))
+	})
+}
+
+// transcodeImage decodes an original image and re-encodes it according to the extension of the
+// `data-saver` image path, shrinking it to fit within the configured dimensions
+func transcodeImage(original io.Reader, imagePath string) ([]byte, error) {
+	// Decode original
+	src, _, err := image.Decode(original)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode original: %v", err)
+	}
+
+	// Shrink image to fit
+	width, height := fitDimensions(src.Bounds().Dx(), src.Bounds().Dy(), viper.GetInt("transcode.max_width_pixels"), viper.GetInt("transcode.max_height_pixels"))
+	extension := strings.ToLower(path.Ext(imagePath))
+	dst := resizeImage(src, width, height, extension == ".jpg" || extension == ".jpeg")
+
+	// Encode as requested format
+	var buf bytes.Buffer
+	switch extension {
+	case ".jpg", ".jpeg":
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: viper.GetInt("transcode.jpeg_quality")})
+	case ".png":
+		err = png.Encode(&buf, dst)
+	case ".gif":
+		err = gif.Encode(&buf, dst, nil)
+	default:
+		err = fmt.Errorf("unsupported extension '%s'", extension)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode image: %v", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// fitDimensions scales width and height down to fit within the maximums, where a maximum of 0 is unbounded
+func fitDimensions(width int, height int, maxWidth int, maxHeight int) (int, int) {
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && height > maxHeight && float64(maxHeight)/float64(height) < scale {
+		scale = float64(maxHeight) / float64(height)
+	}
+	if scale >= 1 {
+		return width, height
+	}
+
+	// Never shrink down to nothing
+	scaledWidth, scaledHeight := int(float64(width)*scale), int(float64(height)*scale)
+	if scaledWidth < 1 {
+		scaledWidth = 1
+	}
+	if scaledHeight < 1 {
+		scaledHeight = 1
+	}
+	return scaledWidth, scaledHeight
+}
+
+// resizeImage box-filters an image down to the given dimensions, optionally flattening transparency onto white
+func resizeImage(src image.Image, width int, height int, opaque bool) *image.RGBA {
+	// Convert source to RGBA
+	bounds := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	if opaque {
+		draw.Draw(rgba, rgba.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	}
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Over)
+
+	// Return as is if no resizing needed
+	if width == bounds.Dx() && height == bounds.Dy() {
+		return rgba
+	}
+
+	// Average every block of source pixels into a destination pixel
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*bounds.Dy()/height, (y+1)*bounds.Dy()/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x*bounds.Dx()/width, (x+1)*bounds.Dx()/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				offset := rgba.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += int(rgba.Pix[offset])
+					g += int(rgba.Pix[offset+1])
+					b += int(rgba.Pix[offset+2])
+					a += int(rgba.Pix[offset+3])
+					offset += 4
+					n++
+				}
+			}
+
+			offset := dst.PixOffset(x, y)
+			dst.Pix[offset] = uint8(r / n)
+			dst.Pix[offset+1] = uint8(g / n)
+			dst.Pix[offset+2] = uint8(b / n)
+			dst.Pix[offset+3] = uint8(a / n)
+		}
+	}
+
+	return dst
+}
+
+// transcode attempts to fulfil a `data-saver` fetch from its cached `data` original instead of
+// upstream, returning false if the fetch should go upstream instead
+func (f *upstreamFetch) transcode() bool {
+	// Only `data-saver` images are generated
+	if !viper.GetBool("transcode.enabled") || !strings.HasPrefix(f.key, "/data-saver/") {
+		return false
+	}
+
+	// Find cached original for page
+	original, err := cache.getPage(f.key)
+	if err != nil {
+		return false
+	}
+	originalFile, err := cache.Open(original)
+	if err != nil {
+		if err := cache.deletePage(f.key); err != nil {
+			log.Warnf("Failed to forget page of %s: %v", f.key, err)
+		}
+		return false
+	}
+	defer originalFile.Close()
+
+	// Prepare logger
+	log := log.WithFields(logrus.Fields{"type": "transcode", "original": original})
+
+	// Transcode original
+	startTime := time.Now()
+	image, err := transcodeImage(originalFile, f.key)
+	if err != nil {
+		log.WithFields(logrus.Fields{"event": "failed", "error": err}).Warnf("Failed to transcode %s from %s: %v", f.key, original, err)
+		clientTranscodedFailedTotal.Inc()
+		return false
+	}
+	log.WithFields(logrus.Fields{"event": "transcoded", "image_length": len(image), "time_taken_ms": time.Since(startTime).Milliseconds()}).Debugf("Transcoded %s from %s in %dms", f.key, original, time.Since(startTime).Milliseconds())
+	clientTranscodedTotal.Inc()
+	clientTranscodedSavedBytesTotal.Add(len(image))
+
+	// Record response information as if it came from upstream
+	f.upstream = original
+	f.transcoded = true
+	f.status = http.StatusOK
+	f.modTime = time.Now()
+	f.header = http.Header{}
+	f.header.Set("Content-Length", strconv.Itoa(len(image)))
+	f.header.Set("Last-Modified", f.modTime.UTC().Format(http.TimeFormat))
+
+	// Write into the cache, falling back to memory if the cache cannot be written to
+	var spool fetchSpool = &memorySpool{}
+	writer, err := cache.Create(f.key)
+	if errors.Is(err, errNotAdmitted) {
+		log.WithFields(logrus.Fields{"event": "not_admitted"}).Debugf("Transcoded %s not admitted into cache", f.key)
+	} else if err != nil {
+		log.WithFields(logrus.Fields{"event": "failed", "error": err}).Warnf("Failed to prepare cache for %s: %v", f.key, err)
+	} else {
+		spool = writer
+	}
+	if _, err := spool.Write(image); err != nil {
+		log.WithFields(logrus.Fields{"event": "failed", "error": err}).Warnf("Failed to spool %s: %v", f.key, err)
+		spool.Close()
+		return false
+	}
+
+	// Share with readers
+	f.mu.Lock()
+	f.spool = spool
+	f.written = int64(len(image))
+	f.mu.Unlock()
+	close(f.ready)
+	f.finish(nil)
+
+	// Commit image to cache
+	if writer != nil {
+		if err := writer.Commit(f.modTime); err != nil {
+			log.WithFields(logrus.Fields{"event": "failed", "error": err}).Warnf("Failed to save %s: %v", f.key, err)
+		}
+	}
+	return true
+}
@@ -0,0 +1,181 @@
+package mdathome
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var (
+	clientUpstreamRetriesTotal  = metrics.NewCounter("client_upstream_retries_total")
+	clientUpstreamRejectedTotal = metrics.NewCounter("client_upstream_rejected_total")
+	clientUpstreamTrippedTotal  = metrics.NewCounter("client_upstream_tripped_total")
+)
+
+// circuitOpenError is returned instead of contacting upstream while the circuit breaker is open
+type circuitOpenError struct {
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("upstream circuit breaker is open, retry after %s", e.retryAfter)
+}
+
+// circuitBreaker stops sending requests upstream after too many consecutive failures
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// State returns how long until the breaker lets requests through again, and whether it currently does
+func (b *circuitBreaker) State() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if remaining := time.Until(b.openUntil); remaining > 0 {
+		return remaining, false
+	}
+	return 0, !b.probing
+}
+
+// Allow reports whether a request may be sent upstream. Once the cooldown has elapsed, a single
+// probe request is let through to decide whether the breaker closes again.
+func (b *circuitBreaker) Allow() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Reject while cooling down
+	cooldown := time.Duration(viper.GetInt("upstream.breaker_cooldown_seconds")) * time.Second
+	if remaining := time.Until(b.openUntil); remaining > 0 {
+		return remaining, false
+	}
+
+	// Only let a single probe through after cooling down
+	if !b.openUntil.IsZero() {
+		if b.probing {
+			return cooldown, false
+		}
+		b.probing = true
+	}
+	return 0, true
+}
+
+// Success records a healthy upstream response, closing the breaker
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.probing = false
+}
+
+// Failure records a failed upstream response, opening the breaker if failures are sustained
+func (b *circuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+
+	// Trip breaker if threshold reached or if the probe failed
+	threshold := viper.GetInt("upstream.breaker_failure_threshold")
+	if b.probing || (threshold > 0 && b.failures >= threshold) {
+		if !b.probing {
+			clientUpstreamTrippedTotal.Inc()
+		}
+		b.openUntil = time.Now().Add(time.Duration(viper.GetInt("upstream.breaker_cooldown_seconds")) * time.Second)
+		b.probing = false
+	}
+}
+
+// isRetryableError reports whether a request failed before upstream sent anything back
+func isRetryableError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// getRetryDelay returns a jittered exponential backoff for the given retry attempt
+func getRetryDelay(attempt int) time.Duration {
+	base := time.Duration(viper.GetInt("upstream.retry_base_delay_milliseconds")) * time.Millisecond
+	max := time.Duration(viper.GetInt("upstream.retry_max_delay_milliseconds")) * time.Millisecond
+
+	// Double delay every attempt, capped at maximum
+	delay := base << uint(attempt)
+	if delay > max || delay <= 0 {
+		delay = max
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	// Wait for between half and all of the delay
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// fetchUpstream requests an image path from the upstream pool, retrying failures that happen before the
+// first byte on another member where possible
+func fetchUpstream(path string) (*http.Response, error) {
+	tried := make(map[*upstreamMember]bool)
+	for attempt := 0; ; attempt++ {
+		// Fail fast if every upstream is known to be unhealthy
+		member := upstreams.Select(tried)
+		if member == nil {
+			clientUpstreamRejectedTotal.Inc()
+			return nil, &circuitOpenError{retryAfter: upstreams.RetryAfter()}
+		}
+		if retryAfter, ok := member.breaker.Allow(); !ok {
+			clientUpstreamRejectedTotal.Inc()
+			return nil, &circuitOpenError{retryAfter: retryAfter}
+		}
+		tried[member] = true
+
+		// Prepare logger
+		url := member.url + path
+		log := log.WithFields(logrus.Fields{"type": "upstream", "upstream": url})
+
+		// Send request
+		startTime := time.Now()
+		resp, err := client.Get(url)
+		failed := err != nil || resp.StatusCode >= 500
+		member.observe(time.Since(startTime), failed)
+		if !failed {
+			member.breaker.Success()
+			return resp, nil
+		}
+		member.breaker.Failure()
+
+		// Give up if not retryable or out of retries
+		retryable := (err != nil && isRetryableError(err)) || (err == nil && resp.StatusCode >= 500)
+		if !retryable || attempt >= viper.GetInt("upstream.max_retries") {
+			return resp, err
+		}
+
+		// Discard failed response before retrying
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		// Back off before retrying
+		delay := getRetryDelay(attempt)
+		if err != nil {
+			log.WithFields(logrus.Fields{"event": "retry", "attempt": attempt + 1, "error": err}).Debugf("Retrying upstream in %s: %v", delay, err)
+		} else {
+			log.WithFields(logrus.Fields{"event": "retry", "attempt": attempt + 1, "status": resp.StatusCode}).Debugf("Retrying upstream in %s: %d", delay, resp.StatusCode)
+		}
+		clientUpstreamRetriesTotal.Inc()
+		time.Sleep(delay)
+	}
+}
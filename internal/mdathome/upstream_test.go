@@ -0,0 +1,127 @@
+package mdathome
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestRetryDelayBacksOff(t *testing.T) {
+	setDefaultConfiguration()
+	for _, test := range []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{0, 50 * time.Millisecond, 100 * time.Millisecond},
+		{1, 100 * time.Millisecond, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond, 800 * time.Millisecond},
+		{5, 1000 * time.Millisecond, 2000 * time.Millisecond},
+		{70, 1000 * time.Millisecond, 2000 * time.Millisecond},
+	} {
+		for i := 0; i < 100; i++ {
+			if delay := getRetryDelay(test.attempt); delay < test.min || delay > test.max {
+				t.Fatalf("Expected delay of attempt %d between %s and %s, got %s", test.attempt, test.min, test.max, delay)
+			}
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	setDefaultConfiguration()
+	viper.Set("upstream.breaker_failure_threshold", 3)
+	t.Cleanup(func() {
+		viper.Set("upstream.breaker_failure_threshold", nil)
+	})
+	b := &circuitBreaker{}
+
+	// Breaker trips once failures are sustained
+	for i := 0; i < 3; i++ {
+		if _, ok := b.Allow(); !ok {
+			t.Fatalf("Expected request %d to be allowed", i)
+		}
+		b.Failure()
+	}
+	if retryAfter, ok := b.Allow(); ok || retryAfter <= 0 || retryAfter > 30*time.Second {
+		t.Fatalf("Expected breaker to be open for up to 30s, got %s, %v", retryAfter, ok)
+	}
+
+	// A single probe is let through after cooling down, and reopens the breaker if it fails
+	b.openUntil = time.Now().Add(-time.Second)
+	if _, ok := b.Allow(); !ok {
+		t.Fatalf("Expected probe to be allowed")
+	}
+	if _, ok := b.Allow(); ok {
+		t.Fatalf("Expected only a single probe")
+	}
+	b.Failure()
+	if _, ok := b.Allow(); ok {
+		t.Fatalf("Expected failed probe to reopen breaker")
+	}
+
+	// A successful probe closes the breaker
+	b.openUntil = time.Now().Add(-time.Second)
+	b.Allow()
+	b.Success()
+	for i := 0; i < 2; i++ {
+		if _, ok := b.Allow(); !ok {
+			t.Fatalf("Expected breaker to be closed")
+		}
+		b.Failure()
+	}
+	if _, ok := b.Allow(); !ok {
+		t.Fatalf("Expected failures before closing to be forgotten")
+	}
+}
+
+func TestFetchUpstreamRetries(t *testing.T) {
+	var requests atomic.Int32
+	var failures atomic.Int32
+	newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if failures.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write(testImage)
+	})
+	viper.Set("upstream.retry_base_delay_milliseconds", 1)
+	viper.Set("upstream.retry_max_delay_milliseconds", 1)
+	t.Cleanup(func() {
+		viper.Set("upstream.retry_base_delay_milliseconds", nil)
+		viper.Set("upstream.retry_max_delay_milliseconds", nil)
+	})
+
+	// Server errors are retried till they run out
+	for _, test := range []struct {
+		failures int32
+		status   int
+		requests int32
+	}{
+		{0, http.StatusOK, 1},
+		{2, http.StatusOK, 3},
+		{3, http.StatusBadGateway, 3},
+	} {
+		requests.Store(0)
+		failures.Store(test.failures)
+		resp, err := fetchUpstream("/data/x/0.png")
+		if err != nil {
+			t.Fatalf("Failed to fetch after %d failures: %v", test.failures, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status || requests.Load() != test.requests {
+			t.Fatalf("Expected status %d after %d requests, got %d after %d", test.status, test.requests, resp.StatusCode, requests.Load())
+		}
+	}
+
+	// Upstream is avoided once its breaker tripped
+	upstreams.members[0].breaker.openUntil = time.Now().Add(time.Minute)
+	requests.Store(0)
+	var circuitErr *circuitOpenError
+	if _, err := fetchUpstream("/data/x/0.png"); !errors.As(err, &circuitErr) || requests.Load() != 0 {
+		t.Fatalf("Expected breaker to reject request, got %v after %d requests", err, requests.Load())
+	}
+}
@@ -56,6 +56,12 @@ func startBackgroundWorker() {
 			}
 
 			serverResponse = *newServerResponse
+
+			// Update upstream pool with image server
+			upstreams.Update(serverResponse.ImageServer)
+
+			// Act on paused and compromised flags
+			updateClientState(newServerResponse)
 		}
 
 		// Wait 15 seconds
@@ -97,6 +103,11 @@ func registerShutdownHandler() {
 			secondsSinceLastRequest = time.Since(timeLastRequest).Seconds()
 		}
 
+		// Write back pending cache updates
+		if cache != nil {
+			cache.Close()
+		}
+
 		// Exit properly
 		os.Exit(0)
 	}()
@@ -0,0 +1,68 @@
+package mdathome
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// magicBytesLength is how many bytes are needed to recognise any supported image format
+const magicBytesLength = 8
+
+var imageMagicBytes = map[string][][]byte{
+	".jpg":  {{0xFF, 0xD8, 0xFF}},
+	".jpeg": {{0xFF, 0xD8, 0xFF}},
+	".png":  {{0x89, 'P', 'N', 'G', '\r', '\n', 0x1A, '\n'}},
+	".gif":  {[]byte("GIF87a"), []byte("GIF89a")},
+}
+
+// payloadError describes why an upstream payload was refused entry into the cache
+type payloadError struct {
+	reason string
+	detail string
+}
+
+func (e *payloadError) Error() string {
+	return fmt.Sprintf("upstream payload rejected due to %s: %s", e.reason, e.detail)
+}
+
+// rejectPayload counts and returns a payloadError
+func rejectPayload(reason string, format string, args ...interface{}) error {
+	metrics.GetOrCreateCounter(fmt.Sprintf(`client_rejected_total{reason=%q}`, reason)).Inc()
+	return &payloadError{reason: reason, detail: fmt.Sprintf(format, args...)}
+}
+
+// checkMagicBytes verifies that the start of a payload matches the extension of its image path
+func checkMagicBytes(imagePath string, head []byte) error {
+	signatures, ok := imageMagicBytes[strings.ToLower(path.Ext(imagePath))]
+	if !ok {
+		return nil
+	}
+	for _, signature := range signatures {
+		if bytes.HasPrefix(head, signature) {
+			return nil
+		}
+	}
+	return rejectPayload("magic", "%s does not start with a %s signature", imagePath, path.Ext(imagePath))
+}
+
+// checkPayload verifies a fully received payload against its advertised length and, for `data`
+// images, the SHA-256 checksum embedded in its filename. An expectedLength below zero is unknown.
+func checkPayload(imagePath string, length int64, expectedLength int64, checksum string) error {
+	// Check length
+	if expectedLength >= 0 && length != expectedLength {
+		return rejectPayload("length", "%s received %d bytes instead of %d", imagePath, length, expectedLength)
+	}
+
+	// Check checksum
+	if strings.HasPrefix(imagePath, "/data/") && checksum != "" {
+		if filenameHash := getFilenameHash(path.Base(imagePath)); filenameHash != "" && filenameHash != checksum {
+			return rejectPayload("checksum", "%s hashed to %s", imagePath, checksum)
+		}
+	}
+
+	return nil
+}
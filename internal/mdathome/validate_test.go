@@ -0,0 +1,111 @@
+package mdathome
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckMagicBytes(t *testing.T) {
+	for _, test := range []struct {
+		path  string
+		head  string
+		valid bool
+	}{
+		{"/data/x/0.png", "\x89PNG\r\n\x1a\n", true},
+		{"/data/x/0.PNG", "\x89PNG\r\n\x1a\n", true},
+		{"/data/x/0.jpg", "\xff\xd8\xff\xe0", true},
+		{"/data/x/0.gif", "GIF89a", true},
+		{"/data/x/0.png", "\xff\xd8\xff\xe0", false},
+		{"/data/x/0.jpg", "<html>", false},
+		{"/data/x/0.webp", "RIFF", true},
+	} {
+		if err := checkMagicBytes(test.path, []byte(test.head)); (err == nil) != test.valid {
+			t.Errorf("%s starting with %q: expected valid %v, got %v", test.path, test.head, test.valid, err)
+		}
+	}
+}
+
+func TestCheckPayload(t *testing.T) {
+	hash := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	for _, test := range []struct {
+		path           string
+		length         int64
+		expectedLength int64
+		checksum       string
+		reason         string
+	}{
+		{"/data/x/x1-" + hash + ".png", 10, 10, hash, ""},
+		{"/data/x/x1-" + hash + ".png", 10, -1, hash, ""},
+		{"/data/x/x1-" + hash + ".png", 9, 10, hash, "length"},
+		{"/data/x/x1-" + hash + ".png", 10, 10, "other", "checksum"},
+		{"/data/x/x1-" + hash + ".png", 10, 10, "", ""},
+		{"/data/x/x1.png", 10, 10, "other", ""},
+		{"/data-saver/x/x1-" + hash + ".jpg", 10, 10, "other", ""},
+	} {
+		err := checkPayload(test.path, test.length, test.expectedLength, test.checksum)
+		var payloadErr *payloadError
+		if test.reason == "" && err != nil || test.reason != "" && (!errors.As(err, &payloadErr) || payloadErr.reason != test.reason) {
+			t.Errorf("%s of %d/%d bytes hashing to %q: expected rejection %q, got %v", test.path, test.length, test.expectedLength, test.checksum, test.reason, err)
+		}
+	}
+}
+
+func TestRejectedPayloadsNotCached(t *testing.T) {
+	checksum := sha256.Sum256(testImage)
+	hash := hex.EncodeToString(checksum[:])
+	c := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/data/x/truncated.png":
+			// Promise more than is sent
+			w.Header().Set("Content-Length", strconv.Itoa(len(testImage)+1000))
+			w.Write(testImage)
+		default:
+			w.Write(testImage)
+		}
+	})
+
+	for _, test := range []struct {
+		key      string
+		rejected bool
+	}{
+		{"/data/x/x1-" + hash + ".png", false},
+		{"/data/x/x1-" + strings.Repeat("0", 64) + ".png", true},
+		{"/data/x/truncated.png", true},
+		{"/data/x/x1.jpg", true},
+	} {
+		// Readers learn of rejections
+		group := newFetchGroup()
+		fetch, _ := group.Join(test.key)
+		err := fetch.Wait()
+		if err == nil {
+			_, err = io.ReadAll(fetch.NewReader())
+		}
+		fetch.Release()
+		if (err != nil) != test.rejected {
+			t.Fatalf("%s: expected rejection %v, got %v", test.key, test.rejected, err)
+		}
+
+		// Only accepted images are committed
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+			group.mu.Lock()
+			running := len(group.fetches)
+			group.mu.Unlock()
+			if running == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: expected fetch to finish", test.key)
+			}
+		}
+		if _, err := c.getEntry(hashRequestURI(test.key)); (err != nil) != test.rejected {
+			t.Fatalf("%s: expected image to be cached %v, got %v", test.key, !test.rejected, err)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package mdathome
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+// verifyReport counts the problems found while verifying the cache
+type verifyReport struct {
+	Checked     int
+	Orphans     int
+	Dangling    int
+	Mismatched  int
+	Corrupted   int
+	Repaired    int
+	FailedFixes int
+}
+
+// VerifyCache checks that the database and storage agree on which images are cached and how large
+// they are, optionally rehashing every image, and repairs any problems found if asked to
+func VerifyCache(repair bool, rehash bool) {
+	// Load configuration without starting any cache threads
+	prepareConfiguration()
+	log.Info("Preparing database...")
+	cache = newCache(viper.GetInt(KeyCacheSize) * 1024 * 1024)
+	defer cache.Close()
+
+	// Verify cache
+	log.Info("Verifying cache...")
+	report, err := cache.verify(repair, rehash)
+	if err != nil {
+		log.Fatalf("Failed to verify cache: %v", err)
+	}
+	log.WithFields(logrus.Fields{
+		"checked":      report.Checked,
+		"orphans":      report.Orphans,
+		"dangling":     report.Dangling,
+		"mismatched":   report.Mismatched,
+		"corrupted":    report.Corrupted,
+		"repaired":     report.Repaired,
+		"failed_fixes": report.FailedFixes,
+	}).Infof("Verified %d images: %d orphaned, %d dangling, %d mismatched, %d corrupted, %d repaired",
+		report.Checked, report.Orphans, report.Dangling, report.Mismatched, report.Corrupted, report.Repaired)
+	if !repair && report.Orphans+report.Dangling+report.Mismatched+report.Corrupted > 0 {
+		log.Warnf("Run again with -repair to fix problems found")
+	}
+}
+
+// verify compares storage against the database, walking both at the same time
+func (c *Cache) verify(repair bool, rehash bool) (verifyReport, error) {
+	var report verifyReport
+
+	// Walk storage and database in parallel
+	var wg sync.WaitGroup
+	var stored map[string]StorageInfo
+	var storageErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		stored = make(map[string]StorageInfo)
+		storageErr = c.storage.Iterate(func(info StorageInfo) error {
+			stored[info.Key] = info
+			return nil
+		})
+	}()
+	entries, urls, err := c.readEntries()
+	wg.Wait()
+	if err != nil {
+		return report, fmt.Errorf("failed to read database: %v", err)
+	}
+	if storageErr != nil {
+		return report, fmt.Errorf("failed to walk storage: %v", storageErr)
+	}
+
+	// Find orphaned images, which the database knows nothing of
+	for key, info := range stored {
+		if _, ok := entries[key]; ok {
+			continue
+		}
+		report.Orphans++
+		log.WithFields(logrus.Fields{"type": "verify", "key": key, "problem": "orphan"}).Warnf("Image %s of %s is not in the database", key, ByteCountIEC(int(info.Size)))
+		if repair {
+			report.record(c.storage.Delete(key))
+		}
+	}
+
+	// Find dangling entries and size mismatches
+	var candidates []KeyPair
+	for key, keyPair := range entries {
+		report.Checked++
+		info, ok := stored[key]
+		if !ok {
+			report.Dangling++
+			log.WithFields(logrus.Fields{"type": "verify", "key": key, "problem": "dangling"}).Warnf("Entry %s has no image in storage", key)
+			if repair {
+				report.record(c.deleteEntry(key))
+			}
+			continue
+		}
+		if info.Size != int64(keyPair.Size) {
+			report.Mismatched++
+			log.WithFields(logrus.Fields{"type": "verify", "key": key, "problem": "size"}).Warnf("Image %s is %d bytes but its entry says %d bytes", key, info.Size, keyPair.Size)
+			if repair {
+				report.record(c.DeleteFileByKey(key))
+			}
+			continue
+		}
+		candidates = append(candidates, keyPair)
+	}
+
+	// Rehash remaining images
+	if rehash {
+		for _, key := range c.rehash(candidates, urls) {
+			report.Corrupted++
+			if repair {
+				report.record(c.DeleteFileByKey(key))
+			}
+		}
+	}
+	return report, nil
+}
+
+// record counts the outcome of a repair
+func (r *verifyReport) record(err error) {
+	if err != nil {
+		log.Errorf("Failed to repair cache: %v", err)
+		r.FailedFixes++
+		return
+	}
+	r.Repaired++
+}
+
+// readEntries returns every entry in the database along with the `data` image paths recorded for
+// transcoding, which carry the expected checksum in their filenames
+func (c *Cache) readEntries() (map[string]KeyPair, map[string]string, error) {
+	entries := make(map[string]KeyPair)
+	urls := make(map[string]string)
+	err := c.database.View(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte("KEYS")).ForEach(func(key []byte, keyPairBytes []byte) error {
+			keyPair, err := decodeKeyPair(key, keyPairBytes)
+			if err != nil {
+				return err
+			}
+			entries[string(key)] = keyPair
+			return nil
+		}); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("PAGES")).ForEach(func(_ []byte, requestURI []byte) error {
+			urls[hashRequestURI(string(requestURI))] = string(requestURI)
+			return nil
+		})
+	})
+	return entries, urls, err
+}
+
+// rehash checks images against the checksum in their filename if known, otherwise against the one
+// recorded when they were cached, returning the keys of those that do not match
+func (c *Cache) rehash(keyPairs []KeyPair, urls map[string]string) []string {
+	var mu sync.Mutex
+	var corrupted []string
+	var wg sync.WaitGroup
+	work := make(chan KeyPair)
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for keyPair := range work {
+				// Work out expected checksum
+				expected := keyPair.SHA256
+				url := keyPair.URL
+				if url == "" {
+					url = urls[keyPair.Key]
+				}
+				if strings.HasPrefix(url, "/data/") {
+					if checksum := getFilenameHash(path.Base(url)); checksum != "" {
+						expected = checksum
+					}
+				}
+				if expected == "" {
+					continue
+				}
+
+				// Hash image
+				actual, err := c.hashObject(keyPair.Key)
+				if err != nil {
+					log.WithFields(logrus.Fields{"type": "verify", "key": keyPair.Key, "error": err}).Warnf("Failed to hash image %s: %v", keyPair.Key, err)
+					continue
+				}
+				if actual != expected {
+					log.WithFields(logrus.Fields{"type": "verify", "key": keyPair.Key, "problem": "checksum", "expected": expected, "calculated": actual}).Warnf("Image %s has checksum %s instead of %s", keyPair.Key, actual, expected)
+					mu.Lock()
+					corrupted = append(corrupted, keyPair.Key)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, keyPair := range keyPairs {
+		work <- keyPair
+	}
+	close(work)
+	wg.Wait()
+	return corrupted
+}
+
+// hashObject returns the hexadecimal SHA-256 of an image in storage
+func (c *Cache) hashObject(key string) (string, error) {
+	object, _, err := c.storage.Get(key)
+	if err != nil {
+		return "", err
+	}
+	defer object.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, object); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
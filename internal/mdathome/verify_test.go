@@ -0,0 +1,105 @@
+package mdathome
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// getTestImagePath returns where the filesystem backend keeps an image
+func getTestImagePath(t *testing.T, c *Cache, requestURI string) string {
+	t.Helper()
+	storage, ok := c.storage.(*filesystemStorage)
+	if !ok {
+		t.Fatalf("expected filesystem storage, got %T", c.storage)
+	}
+	_, imagePath := storage.getPath(storage.roots[0], hashRequestURI(requestURI))
+	return imagePath
+}
+
+func TestVerifyFindsAndRepairsProblems(t *testing.T) {
+	c := newTestCache(t, 1<<30)
+
+	// Cache healthy images
+	for i := 0; i < 4; i++ {
+		if err := c.Set(fmt.Sprintf("/data/chapter/%d.png", i), time.Now(), []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checksummed := fmt.Sprintf("/data/chapter/x1-%x.png", sha256.Sum256([]byte("good")))
+	if err := c.Set(checksummed, time.Now(), []byte("good")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Break them in every way verification knows of
+	if err := os.Remove(getTestImagePath(t, c, "/data/chapter/1.png")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(getTestImagePath(t, c, "/data/chapter/2.png"), []byte("hello!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(getTestImagePath(t, c, checksummed), []byte("gooe"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("/data/chapter/orphan.png", time.Now(), []byte("o")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.deleteEntry(hashRequestURI("/data/chapter/orphan.png")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify without repairing
+	report, err := c.verify(false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := verifyReport{Checked: 5, Orphans: 1, Dangling: 1, Mismatched: 1, Corrupted: 1}
+	if report != expected {
+		t.Fatalf("got %+v, expected %+v", report, expected)
+	}
+
+	// Repair and verify again
+	if report, err = c.verify(true, true); err != nil {
+		t.Fatal(err)
+	}
+	if report.Repaired != 4 || report.FailedFixes != 0 {
+		t.Fatalf("expected 4 repairs, got %+v", report)
+	}
+	if report, err = c.verify(false, true); err != nil {
+		t.Fatal(err)
+	}
+	expected = verifyReport{Checked: 2}
+	if report != expected {
+		t.Fatalf("got %+v after repairing, expected %+v", report, expected)
+	}
+}
+
+func TestVerifySkipsRehashUnlessAsked(t *testing.T) {
+	c := newTestCache(t, 1<<30)
+
+	// Corrupt image without changing its size
+	requestURI := fmt.Sprintf("/data/chapter/x1-%x.png", sha256.Sum256([]byte("good")))
+	if err := c.Set(requestURI, time.Now(), []byte("good")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(getTestImagePath(t, c, requestURI), []byte("gooe"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only rehashing notices
+	report, err := c.verify(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Corrupted != 0 {
+		t.Fatalf("expected no rehash, got %+v", report)
+	}
+	if report, err = c.verify(false, true); err != nil {
+		t.Fatal(err)
+	}
+	if report.Corrupted != 1 {
+		t.Fatalf("expected corruption to be found, got %+v", report)
+	}
+}
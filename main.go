@@ -19,15 +19,20 @@ func main() {
 	// Define arguments
 	printVersion := flag.Bool("version", false, "Prints version of client")
 	shrinkDatabase := flag.Bool("shrink-database", false, "Shrink cache.db (may take a long time)")
+	verifyCache := flag.Bool("verify-cache", false, "Check cache.db against the images in the cache")
+	repairCache := flag.Bool("repair", false, "Fix problems found by -verify-cache")
+	rehashCache := flag.Bool("rehash", false, "Also check images against their checksums with -verify-cache (may take a long time)")
 
 	// Parse arguments
 	flag.Parse()
 
-	// Shrink database if flag given, otherwise start server
+	// Shrink or verify database if flag given, otherwise start server
 	if *printVersion {
 		log.Infof("MD@Home Client %s (%d) written in Golang by @lflare", mdathome.ClientVersion, mdathome.ClientSpecification)
 	} else if *shrinkDatabase {
 		mdathome.ShrinkDatabase()
+	} else if *verifyCache {
+		mdathome.VerifyCache(*repairCache, *rehashCache)
 	} else {
 		mdathome.StartServer()
 	}